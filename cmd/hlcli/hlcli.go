@@ -2,21 +2,28 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"path"
+	"io"
 	"path/filepath"
+	"strings"
 
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/niule-eu/hlcli/internal/hlcli_cmd"
+	"github.com/niule-eu/hlcli/internal/hlcliconfig"
 	"github.com/niule-eu/hlcli/internal/keygen"
 
 	// "github.com/niule-eu/hlcli/internal/netconf"
 	"github.com/niule-eu/hlcli/internal/render"
 	"github.com/niule-eu/hlcli/pkg/config"
 	"github.com/niule-eu/hlcli/pkg/framework"
+	"github.com/niule-eu/hlcli/pkg/redact"
 
 	"github.com/adrg/xdg"
 	"github.com/knadh/koanf/v2"
@@ -26,35 +33,256 @@ import (
 	"github.com/apple/pkl-go/pkl"
 )
 
-type CommandConfig struct {
-	Secrets string `yaml:"secrets,omitempty"`
+// commandConfig returns the settings of the command name, read from the
+// configuration with the schema of hlcli:/config.pkl.
+func commandConfig(cliConfig *koanf.Koanf, name string) (hlcliconfig.CommandConfig, error) {
+	cfg, err := hlcliconfig.FromKoanf(cliConfig)
+	if err != nil {
+		return hlcliconfig.CommandConfig{}, fmt.Errorf("reading configuration: %w", err)
+	}
+	return cfg.Command(name), nil
+}
+
+// valueOf returns the value p points to, the zero value if p is nil.
+func valueOf[T any](p *T) T {
+	if p == nil {
+		var zero T
+		return zero
+	}
+	return *p
+}
+
+// secretsPath returns the absolute path of the secrets file of the root
+// command, empty if there is none.
+func secretsPath(cliConfig *koanf.Koanf) (string, error) {
+	root, err := commandConfig(cliConfig, "root")
+	if err != nil || root.Secrets == nil {
+		return "", err
+	}
+	return filepath.Abs(*root.Secrets)
+}
+
+// secretStores returns the secret stores of the root command, read by
+// modules as sops://<name>/, with absolute paths.
+func secretStores(cliConfig *koanf.Koanf) (map[string]string, error) {
+	root, err := commandConfig(cliConfig, "root")
+	if err != nil {
+		return nil, err
+	}
+	stores := map[string]string{}
+	for name, p := range valueOf(root.SecretStores) {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return nil, err
+		}
+		stores[name] = abs
+	}
+	return stores, nil
+}
+
+// allowedOutputPaths returns the paths outside of the output directory that
+// rendered modules may write to.
+func allowedOutputPaths(cliConfig *koanf.Koanf) ([]string, error) {
+	renderPkl, err := commandConfig(cliConfig, "render-pkl")
+	return valueOf(renderPkl.AllowedOutputPaths), err
 }
 
-type DefaultConfig struct {
-	Commands map[string]CommandConfig `yaml:"commands"`
+// evaluatorFlags override the evaluator settings of render-pkl, shared by
+// render-all.
+func evaluatorFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  "allowed-modules",
+			Usage: "URI `PATTERN`s of the modules that may be imported, replacing the defaults of Pkl (hlcli: is always allowed)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "allowed-resources",
+			Usage: "URI `PATTERN`s of the resources that may be read, replacing the defaults of Pkl and the sops resources of hlcli",
+		},
+		&cli.StringFlag{
+			Name:  "root-dir",
+			Usage: "Refuse local modules and resources outside of `DIR`",
+		},
+		&cli.StringFlag{
+			Name:  "module-cache-dir",
+			Usage: "Cache package: modules in `DIR` (default: ~/.pkl/cache)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "module-path",
+			Usage: "Directory, ZIP or JAR archive `PATH` searched for modulepath: modules",
+		},
+		&cli.DurationFlag{
+			Name:  "eval-timeout",
+			Usage: "Give up on a module whose render takes longer than `DURATION` (default: no limit)",
+		},
+		&cli.StringSliceFlag{
+			Name:    "property",
+			Aliases: []string{"P"},
+			Usage:   "External property read by modules through prop:, as `NAME=VALUE`",
+		},
+		&cli.StringSliceFlag{
+			Name:  "property-from",
+			Usage: "External property taken from the configuration or the secrets, as `NAME=config:KEY` or NAME=secret:KEY",
+		},
+		&cli.StringSliceFlag{
+			Name:  "env-file",
+			Usage: "Add the variables of a dotenv `FILE` to the environment read by modules through env:",
+		},
+		&cli.StringSliceFlag{
+			Name:  "env-from",
+			Usage: "Environment variable taken from the configuration or the secrets, as `NAME=config:KEY` or NAME=secret:KEY",
+		},
+	}
+}
+
+// evaluatorSettings returns the configured evaluator settings, overridden by
+// the flags of evaluatorFlags, with absolute paths.
+func evaluatorSettings(c *cli.Command, cliConfig *koanf.Koanf, secrets *koanf.Koanf) (render.EvaluatorSettings, error) {
+	renderPkl, err := commandConfig(cliConfig, "render-pkl")
+	if err != nil {
+		return render.EvaluatorSettings{}, err
+	}
+	evaluator := valueOf(renderPkl.Evaluator)
+	settings := render.EvaluatorSettings{
+		AllowedModules:   valueOf(evaluator.AllowedModules),
+		AllowedResources: valueOf(evaluator.AllowedResources),
+		RootDir:          valueOf(evaluator.RootDir),
+		Env:              valueOf(evaluator.Env),
+		Properties:       valueOf(evaluator.Properties),
+		ModuleCacheDir:   valueOf(evaluator.ModuleCacheDir),
+		ModulePath:       valueOf(evaluator.ModulePath),
+	}
+	if evaluator.Timeout != nil {
+		settings.Timeout, err = time.ParseDuration(*evaluator.Timeout)
+		if err != nil {
+			return settings, fmt.Errorf("evaluator timeout of render-pkl: %w", err)
+		}
+	}
+
+	if c.IsSet("allowed-modules") {
+		settings.AllowedModules = c.StringSlice("allowed-modules")
+	}
+	if c.IsSet("allowed-resources") {
+		settings.AllowedResources = c.StringSlice("allowed-resources")
+	}
+	if c.IsSet("root-dir") {
+		settings.RootDir = c.String("root-dir")
+	}
+	if c.IsSet("module-cache-dir") {
+		settings.ModuleCacheDir = c.String("module-cache-dir")
+	}
+	if c.IsSet("module-path") {
+		settings.ModulePath = c.StringSlice("module-path")
+	}
+	if c.IsSet("eval-timeout") {
+		settings.Timeout = c.Duration("eval-timeout")
+	}
+
+	properties, err := render.ResolveExternalValues(c.StringSlice("property-from"), cliConfig, secrets)
+	if err != nil {
+		return settings, fmt.Errorf("--property-from: %w", err)
+	}
+	assigned, err := render.ParseExternalValues(c.StringSlice("property"))
+	if err != nil {
+		return settings, fmt.Errorf("--property: %w", err)
+	}
+	settings = settings.WithProperties(properties).WithProperties(assigned)
+	for _, f := range c.StringSlice("env-file") {
+		env, err := render.ReadEnvFile(f)
+		if err != nil {
+			return settings, err
+		}
+		settings = settings.WithEnv(env)
+	}
+	env, err := render.ResolveExternalValues(c.StringSlice("env-from"), cliConfig, secrets)
+	if err != nil {
+		return settings, fmt.Errorf("--env-from: %w", err)
+	}
+	settings = settings.WithEnv(env)
+
+	dirs := []*string{&settings.RootDir, &settings.ModuleCacheDir}
+	for i := range settings.ModulePath {
+		dirs = append(dirs, &settings.ModulePath[i])
+	}
+	for _, dir := range dirs {
+		if *dir == "" {
+			continue
+		}
+		abs, err := filepath.Abs(*dir)
+		if err != nil {
+			return settings, err
+		}
+		*dir = abs
+	}
+	stores, err := secretStores(cliConfig)
+	if err != nil {
+		return settings, err
+	}
+	settings.SecretStores = stores
+	return settings, nil
 }
 
-func debugConfig(cfg *koanf.Koanf) *cli.Command {
+func debugConfig(cfg *koanf.Koanf, secrets *koanf.Koanf) *cli.Command {
 	return &cli.Command{
 		Name: "debug_cfg",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:  "show-secrets",
+				Value: false,
+				Usage: "Print decrypted secret values instead of masking them",
+			},
+		},
 		Action: func(ctx context.Context, c *cli.Command) error {
+			showSecrets := c.Bool("show-secrets")
+			out := redact.Default.Writer(os.Stdout)
+			if showSecrets {
+				out = os.Stdout
+			}
 			for k, v := range cfg.All() {
-				fmt.Println(k, "value is", v)
+				fmt.Fprintln(out, k, "value is", v)
+			}
+			for k, v := range secrets.All() {
+				if showSecrets {
+					fmt.Fprintln(out, k, "secret is", v)
+				} else {
+					fmt.Fprintln(out, k, "secret is", redact.Mask)
+				}
 			}
 			return nil
 		},
 	}
 }
 
-func renderPklCommand(secrets *koanf.Koanf) *cli.Command {
+// reloadSecrets replaces the content of secrets with the current content of
+// the configured secrets file.
+func reloadSecrets(cliConfig *koanf.Koanf, secrets *koanf.Koanf) error {
+	p, err := secretsPath(cliConfig)
+	if err != nil {
+		return err
+	}
+	params := config.NewDefaultLoadSecretsParams()
+	fresh := koanf.NewWithConf(*params.Cfg)
+	err = config.LoadSecrets(params, fresh, func(lsp *config.LoadSecretsParams) {
+		lsp.SecretsPaths = append(lsp.SecretsPaths, p)
+	})
+	if err != nil {
+		return err
+	}
+	secrets.Delete("")
+	secrets.Merge(fresh)
+	return nil
+}
+
+func renderPklCommand(cliConfig *koanf.Koanf, secrets *koanf.Koanf) *cli.Command {
 	return &cli.Command{
-		Name: "render-pkl",
+		Name:  "render-pkl",
+		Usage: "Render a Pkl module: a file, - for stdin, or a URI such as package://<package>@<version>#/<module> or modulepath:/<module>",
 		Arguments: []cli.Argument{
 			&cli.StringArg{
 				Name: "module",
 			},
 		},
-		Flags: []cli.Flag{
+		Flags: append([]cli.Flag{
 			&cli.BoolFlag{
 				Name:    "files",
 				Aliases: []string{"f"},
@@ -69,6 +297,10 @@ func renderPklCommand(secrets *koanf.Koanf) *cli.Command {
 				Aliases: []string{"o"},
 				Value:   "/dev/stdout",
 			},
+			&cli.StringSliceFlag{
+				Name:  "format",
+				Usage: fmt.Sprintf("Render output.value, or the value of --expression, as `FORMAT` instead of with the renderer of the module, one of %s. Repeat to write several formats, the extension of --output being replaced by the one of each (.tfvars for hcl)", strings.Join(render.OutputFormats(), ", ")),
+			},
 			&cli.StringFlag{
 				Name:    "project-file",
 				Aliases: []string{"p"},
@@ -77,42 +309,187 @@ func renderPklCommand(secrets *koanf.Koanf) *cli.Command {
 				Name:    "sops",
 				Aliases: []string{"s"},
 				Value:   false,
-				Usage:   "Encrypt output with SOPS binary (plaintext never written to disk)",
+				Usage:   "Encrypt all output with SOPS (plaintext never written to disk). With --files, modules encrypt single files through sopsFiles of hlcli:/sops.pkl",
 			},
-		},
+			&cli.BoolFlag{
+				Name:    "watch",
+				Aliases: []string{"w"},
+				Value:   false,
+				Usage:   "Render again whenever the module, its imports or the secrets it reads change",
+			},
+			&cli.StringFlag{
+				Name:  "output-dir",
+				Usage: "Write --files output relative to `DIR` and refuse paths escaping it (default: the module directory)",
+			},
+			&cli.BoolFlag{
+				Name:  "prune",
+				Value: false,
+				Usage: "With --files, delete previously generated files the module no longer produces",
+			},
+		}, evaluatorFlags()...),
 		Action: func(ctx context.Context, c *cli.Command) error {
-			var module = c.StringArg("module")
-			if !path.IsAbs(module) {
-				var err error
-				module, err = filepath.Abs(module)
+			settings, err := evaluatorSettings(c, cliConfig, secrets)
+			if err != nil {
+				return err
+			}
+			outputPaths, err := allowedOutputPaths(cliConfig)
+			if err != nil {
+				return err
+			}
+			params := render.RenderPklParams{
+				EvaluatorSettings:  settings,
+				AllowedOutputPaths: outputPaths,
+				Expression:         c.String("expression"),
+				Formats:            c.StringSlice("format"),
+				OutputFile:         c.String("output"),
+				MultipleFileOutput: c.Bool("files"),
+				PklProjectFile:     c.String("project-file"),
+				EncryptWithSops:    c.Bool("sops"),
+				OutputDir:          c.String("output-dir"),
+				LockFile:           c.Bool("files"),
+				Prune:              c.Bool("prune"),
+			}
+			if module := c.StringArg("module"); module == render.StdinModule {
+				text, err := io.ReadAll(os.Stdin)
+				if err != nil {
+					return err
+				}
+				params.ModuleText = string(text)
+			} else {
+				params.PklFile, params.ModuleUri, err = render.ResolveModule(module, "")
 				if err != nil {
 					return err
 				}
 			}
-			effect, err :=
-				render.RenderPkl(
-					render.RenderPklParams{
-						PklFile:            module,
-						Expression:         c.String("expression"),
-						OutputFile:         c.String("output"),
-						MultipleFileOutput: c.Bool("files"),
-						PklProjectFile:     c.String("project-file"),
-						EncryptWithSops:    c.Bool("sops"),
-					},
-					secrets,
-				)
+			// Lock files are written next to the module
+			local := params.PklFile != ""
+			params.LockFile = params.LockFile && local
+			if c.IsSet("format") && c.Bool("files") {
+				return fmt.Errorf("--format cannot be combined with --files")
+			}
+			if c.Bool("prune") && !c.Bool("files") {
+				return fmt.Errorf("--prune requires --files")
+			}
+			if c.Bool("prune") && !local {
+				return fmt.Errorf("--prune requires a local module")
+			}
+			if c.Bool("watch") && !local {
+				return fmt.Errorf("--watch requires a local module")
+			}
+			if c.Bool("watch") {
+				if c.Bool("prune") {
+					return fmt.Errorf("--prune cannot be combined with --watch")
+				}
+				renderer, err := render.NewRenderer(ctx, params, secrets)
+				if err != nil {
+					log.Fatal(err)
+				}
+				defer renderer.Close()
+				watchParams := render.NewDefaultWatchPklParams()
+				p, err := secretsPath(cliConfig)
+				if err != nil {
+					return err
+				}
+				if p != "" {
+					watchParams.SecretsPaths = append(watchParams.SecretsPaths, p)
+					watchParams.ReloadSecrets = func() error { return reloadSecrets(cliConfig, secrets) }
+				}
+				return render.WatchPkl(ctx, renderer, watchParams, func(ctx context.Context, effects ...framework.Effect) error {
+					return hlcli_cmd.Invoke(ctx, c, effects...)
+				})
+			}
+			effect, err := render.RenderPkl(params, secrets)
 			if err != nil {
 				log.Fatal(err)
 			}
-			err = framework.Invoke(effect...)
+			return hlcli_cmd.Invoke(ctx, c, effect...)
+		},
+	}
+}
+
+func renderAllCommand(cliConfig *koanf.Koanf, secrets *koanf.Koanf) *cli.Command {
+	return &cli.Command{
+		Name:  "render-all",
+		Usage: "Render every module listed in a manifest (YAML or Pkl) as a single plan",
+		Arguments: []cli.Argument{
+			&cli.StringArg{
+				Name:  "manifest",
+				Value: "render.yaml",
+			},
+		},
+		Flags: evaluatorFlags(),
+		Action: func(ctx context.Context, c *cli.Command) error {
+			manifestPath, err := filepath.Abs(c.StringArg("manifest"))
 			if err != nil {
-				log.Fatal(err)
+				return err
+			}
+			settings, err := evaluatorSettings(c, cliConfig, secrets)
+			if err != nil {
+				return err
+			}
+			pool := render.NewEvaluatorPool(secrets, settings)
+			defer pool.Close()
+
+			manifest, err := render.LoadRenderManifest(ctx, manifestPath, pool)
+			if err != nil {
+				return err
+			}
+			params := render.NewDefaultRenderManifestParams(manifestPath)
+			params.Workers = int(c.Int("jobs"))
+			params.AllowedOutputPaths, err = allowedOutputPaths(cliConfig)
+			if err != nil {
+				return err
+			}
+			results := render.RenderManifestTargets(ctx, manifest, pool, params)
+			var effects []framework.Effect
+			var errs []error
+			for _, r := range results {
+				if r.Err != nil {
+					errs = append(errs, fmt.Errorf("%s: %w", r.Target.Module, r.Err))
+				}
+				effects = append(effects, r.Effects...)
+			}
+			if err := errors.Join(errs...); err != nil {
+				return err
+			}
+
+			if err := hlcli_cmd.Invoke(ctx, c, effects...); err != nil {
+				return err
+			}
+			if c.String("output-format") != "json" {
+				return render.WriteRenderSummary(os.Stderr, results)
 			}
 			return nil
 		},
 	}
 }
 
+func pklLibraryCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "pkl-library",
+		Usage: fmt.Sprintf("Write the hlcli Pkl package (version %s), served to modules as hlcli:/, to a directory", render.LibraryVersion),
+		Arguments: []cli.Argument{
+			&cli.StringArg{
+				Name:  "dir",
+				Value: "hlcli-pkl",
+			},
+		},
+		Action: func(ctx context.Context, c *cli.Command) error {
+			dir := c.StringArg("dir")
+			effects, err := render.LibraryEffects(dir)
+			if err != nil {
+				return err
+			}
+			if !c.Bool("dry-run") && !c.Bool("diff") {
+				if err := os.MkdirAll(dir, 0755); err != nil {
+					return err
+				}
+			}
+			return hlcli_cmd.Invoke(ctx, c, effects...)
+		},
+	}
+}
+
 func keygen_cmd() *cli.Command {
 	return &cli.Command{
 		Name: "keygen",
@@ -153,11 +530,10 @@ func keygen_cmd() *cli.Command {
 							Comment: c.String("comment"),
 							Output:  c.String("output"),
 						}.Prepare()
-					framework.Invoke(effect...)
 					if err != nil {
 						log.Fatal(err)
 					}
-					return nil
+					return hlcli_cmd.Invoke(ctx, c, effect...)
 				},
 			},
 			{
@@ -176,11 +552,10 @@ func keygen_cmd() *cli.Command {
 							Comment:   c.String("comment"),
 							Output:    c.String("output"),
 						}.Prepare()
-					framework.Invoke(effect...)
 					if err != nil {
 						log.Fatal(err)
 					}
-					return nil
+					return hlcli_cmd.Invoke(ctx, c, effect...)
 				},
 			},
 			{
@@ -191,11 +566,10 @@ func keygen_cmd() *cli.Command {
 							Comment: c.String("comment"),
 							Output:  c.String("output"),
 						}.Prepare()
-					framework.Invoke(effect...)
 					if err != nil {
 						log.Fatal(err)
 					}
-					return nil
+					return hlcli_cmd.Invoke(ctx, c, effect...)
 
 				},
 			},
@@ -227,7 +601,7 @@ func no_config() error {
 	if err != nil {
 		return err
 	}
-	defaultConfig, err := yaml.Marshal(DefaultConfig{Commands: map[string]CommandConfig{"root": {}}})
+	defaultConfig, err := yaml.Marshal(map[string]any{"commands": map[string]any{"root": map[string]any{}}})
 	if err != nil {
 		return err
 	}
@@ -244,15 +618,18 @@ func get_default_config_path() string {
 	if err != nil {
 		log.Fatal(err)
 	}
-	cfg_path := filepath.Join(cwd, ".hlcli.yaml")
-	_, err = os.Stat(cfg_path)
-	if err == nil {
-		return cfg_path
-	} else {
-		log.Println("No config file found in current working directory. Searching for config file in XDG directories.")
+	for _, name := range []string{".hlcli.pkl", ".hlcli.yaml"} {
+		cfg_path := filepath.Join(cwd, name)
+		if _, err := os.Stat(cfg_path); err == nil {
+			return cfg_path
+		}
 	}
+	log.Println("No config file found in current working directory. Searching for config file in XDG directories.")
 
-	p, err := xdg.SearchConfigFile("hlcli/config.yaml")
+	p, err := xdg.SearchConfigFile("hlcli/config.pkl")
+	if err != nil {
+		p, err = xdg.SearchConfigFile("hlcli/config.yaml")
+	}
 	if err != nil {
 		err = no_config()
 		if err != nil {
@@ -274,16 +651,18 @@ func load_config(cliConfig *koanf.Koanf, sopsSecrets *koanf.Koanf) cli.BeforeFun
 		}
 		err = config.LoadConfig(config.NewDefaultLoadConfigParams(), cliConfig, func(lcp *config.LoadConfigParams) {
 			lcp.CliConfigPaths = append(lcp.CliConfigPaths, cliConfigPath)
+			lcp.PklRenderer = hlcliconfig.RenderYaml
 		})
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		if exists := cliConfig.Exists("commands.root.secrets"); exists {
-			p, err := filepath.Abs(cliConfig.String("commands.root.secrets"))
-			if err != nil {
-				log.Fatal(err)
-			}
+		// Also checks the configuration against the schema
+		p, err := secretsPath(cliConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if p != "" {
 			err = config.LoadSecrets(config.NewDefaultLoadSecretsParams(), sopsSecrets, func(lsp *config.LoadSecretsParams) {
 				lsp.SecretsPaths = append(lsp.SecretsPaths, p)
 			})
@@ -297,6 +676,11 @@ func load_config(cliConfig *koanf.Koanf, sopsSecrets *koanf.Koanf) cli.BeforeFun
 }
 
 func main() {
+	// Secrets loaded from SOPS files are registered with redact.Default,
+	// keep them out of logs and error messages
+	log.SetOutput(redact.Default.Writer(os.Stderr))
+	cli.ErrWriter = redact.Default.Writer(os.Stderr)
+
 	koanfConf := koanf.Conf{
 		Delim:       ".",
 		StrictMerge: true,
@@ -314,14 +698,49 @@ func main() {
 				Aliases: []string{"c"},
 				Usage:   "Load configuration from `FILE`",
 			},
+			&cli.BoolFlag{
+				Name:  "dry-run",
+				Value: false,
+				Usage: "Print the planned file writes, deletes and encryptions without applying them",
+			},
+			&cli.BoolFlag{
+				Name:  "diff",
+				Value: false,
+				Usage: "Show a unified diff of pending file changes without applying them, exit with code 2 if there are any",
+			},
+			&cli.BoolFlag{
+				Name:  "no-rollback",
+				Value: false,
+				Usage: "Keep applying effects after a failure instead of rolling back the ones already applied",
+			},
+			&cli.IntFlag{
+				Name:    "jobs",
+				Aliases: []string{"j"},
+				Value:   1,
+				Usage:   "Apply at most `N` independent effects (e.g. SOPS encryptions) concurrently, in order by default",
+			},
+			&cli.StringFlag{
+				Name:      "output-format",
+				Value:     "text",
+				Usage:     "Report effects and their results as `FORMAT` (text or json)",
+				Validator: hlcli_cmd.ValidateOutputFormat,
+			},
+			&cli.StringFlag{
+				Name:  "report-file",
+				Usage: "Write the --output-format json report to `FILE` instead of stdout",
+			},
 		},
-		Before: load_config(cliConfig, sopsSecrets),
+		Before:    load_config(cliConfig, sopsSecrets),
+		ErrWriter: cli.ErrWriter,
 		Commands: []*cli.Command{
-			debugConfig(cliConfig),
+			debugConfig(cliConfig, sopsSecrets),
 			keygen_cmd(),
 			// netconf_cmd(),
-			renderPklCommand(sopsSecrets),
+			renderPklCommand(cliConfig, sopsSecrets),
+			renderAllCommand(cliConfig, sopsSecrets),
+			pklLibraryCommand(),
 			hlcli_cmd.GhAssetCmd(sopsSecrets),
+			hlcli_cmd.SecretsCmd(cliConfig),
 			{
 				Name:            "tofu",
 				Aliases:         []string{"tf"},
@@ -348,7 +767,9 @@ func main() {
 			},
 		},
 	}
-	if err := app.Run(context.Background(), os.Args); err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := app.Run(ctx, os.Args); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -3,7 +3,6 @@ package hlcli_cmd
 import (
 	"context"
 	"fmt"
-	"log"
 	"os"
 	"regexp"
 	"strings"
@@ -58,6 +57,7 @@ func GhAssetCmd(secrets *koanf.Koanf) *cli.Command {
 				Action: func(ctx context.Context, c *cli.Command) error {
 					checksumsPattern := c.String("checksums-pattern")
 					res, err := ghasset.GetAsset(
+						ctx,
 						secrets.String(c.String("token-ref")),
 						ghasset.ReleaseAssetQuery{
 							Owner:            c.String("owner"),
@@ -68,8 +68,7 @@ func GhAssetCmd(secrets *koanf.Koanf) *cli.Command {
 					if err != nil {
 						return err
 					}
-					log.Println(res)
-					return nil
+					return Invoke(ctx, c, framework.NewStdOutIO(res.String()))
 				},
 			},
 			{
@@ -88,6 +87,7 @@ func GhAssetCmd(secrets *koanf.Koanf) *cli.Command {
 					res := make([]*ghasset.ReleaseAssetResult, len(queries))
 					for i, q := range queries {
 						a, err := ghasset.GetAsset(
+							ctx,
 							secrets.String(c.String("token-ref")),
 							ghasset.ReleaseAssetQuery{
 								Owner:            q.Owner,
@@ -105,7 +105,7 @@ func GhAssetCmd(secrets *koanf.Koanf) *cli.Command {
 					if err != nil {
 						return err
 					}
-					return eff.Apply()
+					return Invoke(ctx, c, eff)
 				},
 			},
 		},
@@ -0,0 +1,89 @@
+package hlcli_cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/niule-eu/hlcli/pkg/framework"
+	"github.com/niule-eu/hlcli/pkg/redact"
+
+	"github.com/urfave/cli/v3"
+)
+
+// ExitChangesPending is the exit code used by --diff when applying the
+// effects would change files on disk.
+const ExitChangesPending = 2
+
+// Invoke applies effects as one transaction, or only reports what they would
+// do when the global --dry-run or --diff flags are set. With
+// --output-format json, a report of every effect and its outcome is written
+// to the global --report-file, or to stdout instead of human readable output.
+// Effects writing to stdout then require a --report-file, so that their
+// output and the report are not mixed.
+func Invoke(ctx context.Context, c *cli.Command, effects ...framework.Effect) error {
+	jsonOutput := c.String("output-format") == "json"
+	// Diffs and messages may contain values read from the secrets
+	out := redact.Default.Writer(os.Stdout)
+	if c.Bool("diff") {
+		diff := framework.NewDiffEffect(out, effects...)
+		if err := diff.Apply(); err != nil {
+			return err
+		}
+		if diff.Changes > 0 {
+			return cli.Exit(fmt.Sprintf("%d file(s) would change", diff.Changes), ExitChangesPending)
+		}
+		return nil
+	}
+	if c.Bool("dry-run") {
+		if jsonOutput {
+			report := framework.PlanReport(effects...)
+			report.Redact(redact.Default)
+			return writeReport(c, report)
+		}
+		return framework.WritePlan(out, framework.Plan(effects...))
+	}
+	if jsonOutput && c.String("report-file") == "" && framework.WritesStdout(framework.Plan(effects...)) {
+		return errors.New("effects write to stdout, set --report-file to get the JSON report")
+	}
+
+	params := &framework.InvokeParams{
+		Rollback: !c.Bool("no-rollback"),
+		Workers:  int(c.Int("jobs")),
+	}
+	if jsonOutput {
+		params.Report = &framework.Report{Effects: []framework.EffectReport{}}
+	}
+	err := framework.InvokeWithParams(ctx, params, effects...)
+	if jsonOutput {
+		params.Report.Redact(redact.Default)
+		if writeErr := writeReport(c, params.Report); writeErr != nil {
+			return errors.Join(err, writeErr)
+		}
+	}
+	return err
+}
+
+// writeReport writes report to the global --report-file, stdout if unset.
+func writeReport(c *cli.Command, report *framework.Report) error {
+	path := c.String("report-file")
+	if path == "" {
+		return report.Write(os.Stdout)
+	}
+	var buf bytes.Buffer
+	if err := report.Write(&buf); err != nil {
+		return err
+	}
+	content := buf.Bytes()
+	return framework.NewDefaultFileWriteIO(path, &content).Apply()
+}
+
+// ValidateOutputFormat checks the value of the global --output-format flag.
+func ValidateOutputFormat(format string) error {
+	if format != "text" && format != "json" {
+		return fmt.Errorf("unsupported output format '%s', expected 'text' or 'json'", format)
+	}
+	return nil
+}
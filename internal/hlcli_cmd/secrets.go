@@ -0,0 +1,250 @@
+package hlcli_cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/niule-eu/hlcli/internal/hlcliconfig"
+	"github.com/niule-eu/hlcli/pkg/framework"
+
+	"github.com/knadh/koanf/v2"
+	"github.com/urfave/cli/v3"
+)
+
+// secretsFiles returns the absolute paths of the given files, or of the
+// secrets file configured at commands.root.secrets if none are given.
+func secretsFiles(cfg *koanf.Koanf, files ...string) ([]string, error) {
+	files = slices.DeleteFunc(files, func(f string) bool { return f == "" })
+	if len(files) == 0 {
+		config, err := hlcliconfig.FromKoanf(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("reading configuration: %w", err)
+		}
+		secrets := config.Command("root").Secrets
+		if secrets == nil {
+			return nil, errors.New("no secrets file given and commands.root.secrets is not configured")
+		}
+		files = []string{*secrets}
+	}
+	paths := make([]string, 0, len(files))
+	for _, f := range files {
+		p, err := filepath.Abs(f)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, p)
+	}
+	return paths, nil
+}
+
+// readSecretsFile returns the content and permissions of an encrypted file.
+func readSecretsFile(path string) ([]byte, os.FileMode, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	return content, info.Mode().Perm(), nil
+}
+
+// tmpfsDir returns a memory-backed directory, so that decrypted secrets
+// opened in an editor never reach a disk. It falls back to the default
+// temporary directory when there is none.
+func tmpfsDir() string {
+	for _, dir := range []string{os.Getenv("XDG_RUNTIME_DIR"), "/dev/shm"} {
+		if dir == "" {
+			continue
+		}
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			return dir
+		}
+	}
+	log.Printf("No tmpfs found, decrypted secrets are stored in %s while editing", os.TempDir())
+	return os.TempDir()
+}
+
+// editInTmpfs opens plaintext in $EDITOR, from a private temporary file named
+// after path so that editors recognize its format, and returns the saved
+// content. The temporary file is removed afterwards.
+func editInTmpfs(ctx context.Context, path string, plaintext []byte) ([]byte, error) {
+	dir, err := os.MkdirTemp(tmpfsDir(), "hlcli-secrets-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmpPath := filepath.Join(dir, filepath.Base(path))
+	if err := os.WriteFile(tmpPath, plaintext, 0600); err != nil {
+		return nil, err
+	}
+
+	editor := strings.Fields(os.Getenv("EDITOR"))
+	if len(editor) == 0 {
+		editor = []string{"vi"}
+	}
+	cmd := exec.CommandContext(ctx, editor[0], append(editor[1:], tmpPath)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("editor %s failed: %w", editor[0], err)
+	}
+	return os.ReadFile(tmpPath)
+}
+
+// rekeyEffects re-encrypts every file with the effects built by rekey.
+func rekeyEffects(paths []string, rekey func(content *[]byte, path string) framework.Effect) ([]framework.Effect, error) {
+	var effects []framework.Effect
+	for _, p := range paths {
+		content, perm, err := readSecretsFile(p)
+		if err != nil {
+			return nil, err
+		}
+		write := framework.NewDefaultFileWriteIO(p, &content)
+		write.Permissions = perm
+		effects = append(effects, framework.CompoundEffect{
+			Effects: []framework.Effect{rekey(&content, p), write},
+		})
+	}
+	return effects, nil
+}
+
+func SecretsCmd(cfg *koanf.Koanf) *cli.Command {
+	return &cli.Command{
+		Name:  "secrets",
+		Usage: "Manage SOPS-encrypted files, by default the one configured at commands.root.secrets",
+		Commands: []*cli.Command{
+			{
+				Name:  "decrypt",
+				Usage: "Decrypt a file",
+				Arguments: []cli.Argument{
+					&cli.StringArg{Name: "file"},
+				},
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Value:   "/dev/stdout",
+					},
+				},
+				Action: func(ctx context.Context, c *cli.Command) error {
+					paths, err := secretsFiles(cfg, c.StringArg("file"))
+					if err != nil {
+						return err
+					}
+					content, _, err := readSecretsFile(paths[0])
+					if err != nil {
+						return err
+					}
+					write := framework.NewDefaultFileWriteIO(c.String("output"), &content)
+					write.Permissions = 0600
+					return Invoke(ctx, c, framework.CompoundEffect{
+						Effects: []framework.Effect{
+							framework.NewSopsDecryptEffect(&content, paths[0], nil),
+							write,
+						},
+					})
+				},
+			},
+			{
+				Name:  "edit",
+				Usage: "Edit a file decrypted in $EDITOR, and encrypt it again with the same keys on save",
+				Arguments: []cli.Argument{
+					&cli.StringArg{Name: "file"},
+				},
+				Action: func(ctx context.Context, c *cli.Command) error {
+					// The file would be decrypted and opened before anything is planned
+					if c.Bool("dry-run") || c.Bool("diff") {
+						return errors.New("secrets edit cannot be combined with --dry-run or --diff")
+					}
+					paths, err := secretsFiles(cfg, c.StringArg("file"))
+					if err != nil {
+						return err
+					}
+					path := paths[0]
+					ciphertext, perm, err := readSecretsFile(path)
+					if err != nil {
+						return err
+					}
+					plaintext := slices.Clone(ciphertext)
+					if err := framework.NewSopsDecryptEffect(&plaintext, path, nil).ApplyContext(ctx); err != nil {
+						return err
+					}
+					edited, err := editInTmpfs(ctx, path, plaintext)
+					if err != nil {
+						return err
+					}
+					if bytes.Equal(edited, plaintext) {
+						log.Printf("%s unchanged", path)
+						return nil
+					}
+
+					encrypt := framework.NewSopsEncryptEffect(&edited, "", path, nil)
+					encrypt.Original = ciphertext
+					write := framework.NewDefaultFileWriteIO(path, &edited)
+					write.Permissions = perm
+					return Invoke(ctx, c, framework.CompoundEffect{
+						Effects: []framework.Effect{encrypt, write},
+					})
+				},
+			},
+			{
+				Name:  "rotate",
+				Usage: "Encrypt files with a new data key",
+				Arguments: []cli.Argument{
+					&cli.StringArgs{Name: "files", Min: 0, Max: -1},
+				},
+				Action: func(ctx context.Context, c *cli.Command) error {
+					paths, err := secretsFiles(cfg, c.StringArgs("files")...)
+					if err != nil {
+						return err
+					}
+					effects, err := rekeyEffects(paths, func(content *[]byte, path string) framework.Effect {
+						return framework.NewSopsRotateEffect(content, path, nil)
+					})
+					if err != nil {
+						return err
+					}
+					return Invoke(ctx, c, effects...)
+				},
+			},
+			{
+				Name:  "updatekeys",
+				Usage: "Sync the master keys of files with the matching SOPS creation rules",
+				Arguments: []cli.Argument{
+					&cli.StringArgs{Name: "files", Min: 0, Max: -1},
+				},
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "sops-config",
+						Usage: "Read creation rules from `FILE` instead of the discovered .sops.yaml",
+					},
+				},
+				Action: func(ctx context.Context, c *cli.Command) error {
+					paths, err := secretsFiles(cfg, c.StringArgs("files")...)
+					if err != nil {
+						return err
+					}
+					effects, err := rekeyEffects(paths, func(content *[]byte, path string) framework.Effect {
+						return framework.NewSopsUpdateKeysEffect(content, c.String("sops-config"), path, nil)
+					})
+					if err != nil {
+						return err
+					}
+					return Invoke(ctx, c, effects...)
+				},
+			},
+		},
+	}
+}
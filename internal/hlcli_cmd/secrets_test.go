@@ -0,0 +1,68 @@
+package hlcli_cmd
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/niule-eu/hlcli/pkg/framework"
+	testutils "github.com/niule-eu/hlcli/test"
+
+	"github.com/knadh/koanf/v2"
+	"github.com/urfave/cli/v3"
+)
+
+func TestSecretsEdit(t *testing.T) {
+	execEnv := testutils.NewSopsExecEnv(t)
+	t.Setenv("SOPS_AGE_KEY", execEnv.EnvVars["SOPS_AGE_KEY"])
+
+	secrets := execEnv.GetYamlPath()
+	content := []byte("data: secret\n")
+	if err := framework.NewSopsEncryptEffect(&content, execEnv.EnvVars["SOPS_CONFIG"], secrets, execEnv.EnvVars).Apply(); err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	if err := os.WriteFile(secrets, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// The editor only records that it was launched
+	opened := filepath.Join(t.TempDir(), "opened")
+	editor := filepath.Join(t.TempDir(), "editor.sh")
+	if err := os.WriteFile(editor, []byte("#!/bin/sh\ntouch "+opened+"\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("EDITOR", editor)
+
+	edit := func(args ...string) error {
+		root := &cli.Command{
+			Name: "hlcli",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{Name: "dry-run"},
+				&cli.BoolFlag{Name: "diff"},
+			},
+			Commands: []*cli.Command{SecretsCmd(koanf.New("."))},
+		}
+		args = append(append([]string{"hlcli"}, args...), "secrets", "edit", secrets)
+		return root.Run(context.Background(), args)
+	}
+
+	for _, flag := range []string{"--dry-run", "--diff"} {
+		t.Run("refuses "+flag, func(t *testing.T) {
+			if err := edit(flag); err == nil {
+				t.Fatalf("Expected %s to be refused", flag)
+			}
+			if testutils.FileExists(t, opened) {
+				t.Error("Expected the editor not to be launched")
+			}
+		})
+	}
+
+	t.Run("opens the decrypted file", func(t *testing.T) {
+		if err := edit(); err != nil {
+			t.Fatalf("edit failed: %v", err)
+		}
+		if !testutils.FileExists(t, opened) {
+			t.Error("Expected the editor to be launched")
+		}
+	})
+}
@@ -0,0 +1,83 @@
+// Package hlcliconfig holds the Go bindings of hlcli:/config.pkl, the schema
+// of the hlcli configuration. The *.pkl.go files are generated by pkl-gen-go,
+// run `go generate` after changing the schema.
+package hlcliconfig
+
+//go:generate pkl-gen-go ../render/pkl/config.pkl --mapping hlcli.config=github.com/niule-eu/hlcli/internal/hlcliconfig --base-path github.com/niule-eu/hlcli/internal/hlcliconfig
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"github.com/apple/pkl-go/pkl"
+	"github.com/go-viper/mapstructure/v2"
+	"github.com/knadh/koanf/v2"
+	"github.com/niule-eu/hlcli/internal/render"
+)
+
+// RenderYaml evaluates the configuration module at path, which amends
+// hlcli:/config.pkl, and renders it as YAML, the format of .hlcli.yaml.
+// Evaluation fails on values not matching the schema.
+func RenderYaml(path string) ([]byte, error) {
+	ctx := context.Background()
+	evaluator, err := pkl.NewEvaluator(ctx, pkl.PreconfiguredOptions, pkl.WithModuleReader(render.HlcliModuleReader{}))
+	if err != nil {
+		return nil, err
+	}
+	defer evaluator.Close()
+	// Modules that do not amend the schema fail to decode
+	if _, err := Load(ctx, evaluator, pkl.FileSource(path)); err != nil {
+		return nil, err
+	}
+	text, err := evaluator.EvaluateOutputText(ctx, pkl.FileSource(path))
+	if err != nil {
+		return nil, err
+	}
+	return []byte(text), nil
+}
+
+// InvalidSettingError is returned when a setting does not match the
+// constraints of its property in hlcli:/config.pkl.
+type InvalidSettingError struct {
+	Key      string
+	Value    string
+	Expected string
+}
+
+func (e *InvalidSettingError) Error() string {
+	return fmt.Sprintf("Invalid value '%s' of %s, expected %s", e.Value, e.Key, e.Expected)
+}
+
+// durationRe is the constraint of Evaluator.timeout.
+var durationRe = regexp.MustCompile(`^(\d+(\.\d+)?(ns|us|µs|ms|s|m|h))+$`)
+
+// FromKoanf returns the configuration loaded into k, from YAML, Pkl or the
+// environment. Whatever its source, it is checked as config.pkl checks
+// Pkl configurations: unknown properties, values of the wrong type and
+// values breaking the constraints of the schema are rejected.
+func FromKoanf(k *koanf.Koanf) (Config, error) {
+	var cfg Config
+	err := k.UnmarshalWithConf("", &cfg, koanf.UnmarshalConf{
+		Tag:           "pkl",
+		DecoderConfig: &mapstructure.DecoderConfig{ErrorUnused: true},
+	})
+	if err != nil {
+		return cfg, err
+	}
+	for name, command := range cfg.Commands {
+		if e := command.Evaluator; e != nil && e.Timeout != nil && !durationRe.MatchString(*e.Timeout) {
+			return cfg, &InvalidSettingError{
+				Key:      "commands." + name + ".evaluator.timeout",
+				Value:    *e.Timeout,
+				Expected: "a duration such as 30s",
+			}
+		}
+	}
+	return cfg, nil
+}
+
+// Command returns the settings of the command name, empty if it has none.
+func (c Config) Command(name string) CommandConfig {
+	return c.Commands[name]
+}
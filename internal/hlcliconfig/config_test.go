@@ -0,0 +1,203 @@
+package hlcliconfig
+
+import (
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/knadh/koanf/v2"
+	"github.com/niule-eu/hlcli/internal/render"
+	"github.com/niule-eu/hlcli/pkg/config"
+)
+
+const testConfig = `commands:
+  root:
+    secrets: secrets.yaml
+    secret_stores:
+      prod: prod.secrets.yaml
+  render-pkl:
+    allowed_output_paths: [/etc/nginx]
+    evaluator:
+      allowed_resources: ["env:", "sops:"]
+      env:
+        STAGE: prod
+      timeout: 30s
+`
+
+func loadConfig(t *testing.T, path string, pklRenderer func(string) ([]byte, error)) (*koanf.Koanf, error) {
+	t.Helper()
+	params := config.NewDefaultLoadConfigParams()
+	params.EnvVarsPrefixes = []string{}
+	k := koanf.NewWithConf(*params.Cfg)
+	err := config.LoadConfig(params, k, func(lcp *config.LoadConfigParams) {
+		lcp.CliConfigPaths = append(lcp.CliConfigPaths, path)
+		lcp.PklRenderer = pklRenderer
+	})
+	return k, err
+}
+
+func TestFromKoanf(t *testing.T) {
+	dir := t.TempDir()
+	yamlPath := filepath.Join(dir, ".hlcli.yaml")
+	pklPath := filepath.Join(dir, ".hlcli.pkl")
+	if err := os.WriteFile(yamlPath, []byte(testConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(pklPath, []byte(`amends "hlcli:/config.pkl"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Stands in for RenderYaml, which needs the pkl binary
+	renderedPkl := func(path string) ([]byte, error) {
+		if path != pklPath {
+			t.Errorf("Expected %s to be rendered, got %s", pklPath, path)
+		}
+		return []byte(testConfig), nil
+	}
+
+	for name, path := range map[string]string{"yaml": yamlPath, "pkl": pklPath} {
+		t.Run("reads "+name+" configurations", func(t *testing.T) {
+			k, err := loadConfig(t, path, renderedPkl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := FromKoanf(k)
+			if err != nil {
+				t.Fatal(err)
+			}
+			root := cfg.Command("root")
+			if root.Secrets == nil || *root.Secrets != "secrets.yaml" || (*root.SecretStores)["prod"] != "prod.secrets.yaml" {
+				t.Errorf("Unexpected root settings %+v", root)
+			}
+			renderPkl := cfg.Command("render-pkl")
+			if !slices.Equal(*renderPkl.AllowedOutputPaths, []string{"/etc/nginx"}) || renderPkl.Secrets != nil {
+				t.Errorf("Unexpected render-pkl settings %+v", renderPkl)
+			}
+			evaluator := renderPkl.Evaluator
+			if evaluator == nil || *evaluator.Timeout != "30s" || (*evaluator.Env)["STAGE"] != "prod" || evaluator.RootDir != nil {
+				t.Errorf("Unexpected evaluator settings %+v", evaluator)
+			}
+			if cfg.Command("missing").Evaluator != nil {
+				t.Error("Expected empty settings for unconfigured commands")
+			}
+		})
+	}
+
+	t.Run("rejects what the schema rejects", func(t *testing.T) {
+		for name, content := range map[string]string{
+			"unknown properties":   "commands:\n  root:\n    secret: secrets.yaml\n",
+			"unknown top level":    "command:\n  root:\n    secrets: secrets.yaml\n",
+			"values of wrong type": "commands:\n  render-pkl:\n    allowed_output_paths: /etc/nginx\n",
+			"invalid timeouts":     "commands:\n  render-pkl:\n    evaluator:\n      timeout: 30 seconds\n",
+		} {
+			path := filepath.Join(t.TempDir(), ".hlcli.yaml")
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			k, err := loadConfig(t, path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := FromKoanf(k); err == nil {
+				t.Errorf("%s: expected error, got nil", name)
+			}
+		}
+	})
+
+	t.Run("refuses pkl configurations without renderer", func(t *testing.T) {
+		if _, err := loadConfig(t, pklPath, nil); err == nil {
+			t.Error("Expected error, got nil")
+		}
+	})
+}
+
+// pklProperties returns the properties of each class of a Pkl module, the
+// module class being named "".
+func pklProperties(module string) map[string][]string {
+	properties := map[string][]string{}
+	class := ""
+	classRe := regexp.MustCompile(`^class (\w+)`)
+	propertyRe := regexp.MustCompile(`^\s*(\w+):`)
+	for _, line := range strings.Split(module, "\n") {
+		if m := classRe.FindStringSubmatch(line); m != nil {
+			class = m[1]
+		} else if m := propertyRe.FindStringSubmatch(line); m != nil {
+			properties[class] = append(properties[class], m[1])
+		}
+	}
+	return properties
+}
+
+func pklTags(v any) []string {
+	var tags []string
+	typ := reflect.TypeOf(v)
+	for i := range typ.NumField() {
+		tags = append(tags, typ.Field(i).Tag.Get("pkl"))
+	}
+	return tags
+}
+
+// The bindings are generated by pkl-gen-go, which needs the pkl binary.
+// Catch schema changes that were not followed by `go generate`.
+func TestBindingsMatchSchema(t *testing.T) {
+	schema, err := render.HlcliModuleReader{}.Read(url.URL{Scheme: "hlcli", Path: "/config.pkl"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	properties := pklProperties(schema)
+	for class, binding := range map[string]any{"": Config{}, "CommandConfig": CommandConfig{}, "Evaluator": Evaluator{}} {
+		if tags := pklTags(binding); !slices.Equal(tags, properties[class]) {
+			t.Errorf("%T has properties %v, the schema %v, run go generate", binding, tags, properties[class])
+		}
+	}
+}
+
+func TestRenderYaml(t *testing.T) {
+	if _, err := exec.LookPath("pkl"); err != nil {
+		t.Skip("RenderYaml needs the pkl binary")
+	}
+	dir := t.TempDir()
+	write := func(t *testing.T, content string) string {
+		t.Helper()
+		path := filepath.Join(dir, ".hlcli.pkl")
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	t.Run("renders configurations as YAML", func(t *testing.T) {
+		content, err := RenderYaml(write(t, `amends "hlcli:/config.pkl"
+commands { ["root"] { secrets = "secrets.yaml" } }
+`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := "commands:\n  root:\n    secrets: secrets.yaml\n"
+		if string(content) != expected {
+			t.Errorf("Expected:\n%s\ngot:\n%s", expected, content)
+		}
+	})
+
+	for name, content := range map[string]string{
+		"unknown properties": `amends "hlcli:/config.pkl"
+commands { ["root"] { secret = "secrets.yaml" } }
+`,
+		"invalid timeouts": `amends "hlcli:/config.pkl"
+commands { ["render-pkl"] { evaluator { timeout = "30 seconds" } } }
+`,
+		"modules not amending the schema": `commands { ["root"] { secrets = "secrets.yaml" } }
+`,
+	} {
+		t.Run("rejects "+name, func(t *testing.T) {
+			if _, err := RenderYaml(write(t, content)); err == nil {
+				t.Error("Expected error, got nil")
+			}
+		})
+	}
+}
@@ -0,0 +1,326 @@
+package render
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/apple/pkl-go/pkl"
+	"github.com/klauspost/compress/zstd"
+)
+
+// ArchiveMemberNotFoundError is returned when reading a member missing from
+// an archive. It matches fs.ErrNotExist.
+type ArchiveMemberNotFoundError struct {
+	Archive string
+	Member  string
+}
+
+func (e *ArchiveMemberNotFoundError) Error() string {
+	return fmt.Sprintf("No member '%s' in archive '%s'", e.Member, e.Archive)
+}
+
+func (e *ArchiveMemberNotFoundError) Unwrap() error { return fs.ErrNotExist }
+
+// SopsTarResourceReader reads members of SOPS-encrypted tar archives,
+// optionally gzip- or zstd-compressed, either as `sopstar:/archive.tar#member` or as
+// `sopstar:/archive.tar/member`. In the latter form, archives are
+// directories that can be listed and globbed.
+type SopsTarResourceReader struct {
+	sopsFiles
+}
+
+func (r SopsTarResourceReader) Scheme() string { return "sopstar" }
+
+func (r SopsTarResourceReader) IsGlobbable() bool { return true }
+
+func (r SopsTarResourceReader) HasHierarchicalUris() bool { return true }
+
+func (r SopsTarResourceReader) ListElements(url url.URL) ([]pkl.PathElement, error) {
+	return listArchive(url, openTar, r.sopsFiles)
+}
+
+func (r SopsTarResourceReader) Read(url url.URL) ([]byte, error) {
+	return readArchive(url, openTar, r.sopsFiles)
+}
+
+// SopsZipResourceReader reads members of SOPS-encrypted zip archives, the
+// same way SopsTarResourceReader reads tar archives.
+type SopsZipResourceReader struct {
+	sopsFiles
+}
+
+func (r SopsZipResourceReader) Scheme() string { return "sopszip" }
+
+func (r SopsZipResourceReader) IsGlobbable() bool { return true }
+
+func (r SopsZipResourceReader) HasHierarchicalUris() bool { return true }
+
+func (r SopsZipResourceReader) ListElements(url url.URL) ([]pkl.PathElement, error) {
+	return listArchive(url, openZip, r.sopsFiles)
+}
+
+func (r SopsZipResourceReader) Read(url url.URL) ([]byte, error) {
+	return readArchive(url, openZip, r.sopsFiles)
+}
+
+// archiveMembers holds the decrypted content of an archive.
+type archiveMembers struct {
+	files map[string][]byte
+	dirs  map[string]bool // Including implicit parents, "" being the root
+}
+
+func newArchiveMembers() *archiveMembers {
+	return &archiveMembers{files: map[string][]byte{}, dirs: map[string]bool{"": true}}
+}
+
+// add records a member, named as in the archive.
+func (a *archiveMembers) add(name string, isDir bool, content []byte) {
+	name = strings.Trim(path.Clean("/"+name), "/")
+	if isDir {
+		a.dirs[name] = true
+	} else {
+		a.files[name] = content
+	}
+	for dir := path.Dir(name); dir != "." && !a.dirs[dir]; dir = path.Dir(dir) {
+		a.dirs[dir] = true
+	}
+}
+
+// children returns the members directly in dir, by name, true for
+// directories.
+func (a *archiveMembers) children(dir string) map[string]bool {
+	children := map[string]bool{}
+	add := func(name string, isDir bool) {
+		parent := path.Dir(name)
+		if parent == "." {
+			parent = ""
+		}
+		if name != "" && parent == dir {
+			children[path.Base(name)] = isDir
+		}
+	}
+	for name := range a.dirs {
+		add(name, true)
+	}
+	for name := range a.files {
+		add(name, false)
+	}
+	return children
+}
+
+// read returns the content of the member name, normalized as by add.
+// Directories read as the listing of their members, one per line, with a
+// trailing "/" for directories.
+func (a *archiveMembers) read(archive string, name string) ([]byte, error) {
+	name = strings.Trim(path.Clean("/"+name), "/")
+	if content, ok := a.files[name]; ok {
+		return content, nil
+	}
+	if !a.dirs[name] {
+		return nil, &ArchiveMemberNotFoundError{Archive: archive, Member: name}
+	}
+	var listing bytes.Buffer
+	for _, e := range sortedElements(pathElements(a.children(name))) {
+		listing.WriteString(e.Name())
+		if e.IsDirectory() {
+			listing.WriteString("/")
+		}
+		listing.WriteString("\n")
+	}
+	return listing.Bytes(), nil
+}
+
+func pathElements(children map[string]bool) []pkl.PathElement {
+	elements := make([]pkl.PathElement, 0, len(children))
+	for name, isDir := range children {
+		elements = append(elements, pkl.NewPathElement(name, isDir))
+	}
+	return elements
+}
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// openTar reads a tar archive, decompressing it first if it is gzip or zstd
+// compressed.
+func openTar(content []byte) (*archiveMembers, error) {
+	var r io.Reader = bytes.NewReader(content)
+	switch {
+	case bytes.HasPrefix(content, gzipMagic):
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	case bytes.HasPrefix(content, zstdMagic):
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	members := newArchiveMembers()
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return members, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			members.add(hdr.Name, true, nil)
+		case tar.TypeReg:
+			content, err := io.ReadAll(tr)
+			if err != nil {
+				return nil, err
+			}
+			members.add(hdr.Name, false, content)
+		}
+	}
+}
+
+// openZip reads a zip archive.
+func openZip(content []byte) (*archiveMembers, error) {
+	zr, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return nil, err
+	}
+	members := newArchiveMembers()
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			members.add(f.Name, true, nil)
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		content, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		members.add(f.Name, false, content)
+	}
+	return members, nil
+}
+
+// openArchive decrypts the archive at p and reads its members with open.
+func openArchive(p string, open func([]byte) (*archiveMembers, error), files sopsFiles) (*archiveMembers, error) {
+	secretsBytes, err := files.decrypt(p)
+	if err != nil {
+		return nil, err
+	}
+	members, err := open(secretsBytes)
+	if err != nil {
+		return nil, fmt.Errorf("reading archive '%s': %w", p, err)
+	}
+	return members, nil
+}
+
+// listArchive lists the members directly under the directory of an archive
+// addressed by url. Outside of archives, it lists the local directory, its
+// files being archives, hence directories.
+func listArchive(url url.URL, open func([]byte) (*archiveMembers, error), files sopsFiles) ([]pkl.PathElement, error) {
+	archive, member, err := splitArchivePath(url.Path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(archive)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		entries, err := os.ReadDir(archive)
+		if err != nil {
+			return nil, err
+		}
+		elements := make([]pkl.PathElement, 0, len(entries))
+		for _, e := range entries {
+			elements = append(elements, pkl.NewPathElement(e.Name(), true))
+		}
+		return sortedElements(elements), nil
+	}
+
+	members, err := openArchive(archive, open, files)
+	if err != nil {
+		return nil, err
+	}
+	return sortedElements(pathElements(members.children(member))), nil
+}
+
+// readArchive reads the member of an archive addressed by url, by path or
+// by fragment. Without either, it reads the whole decrypted archive.
+func readArchive(url url.URL, open func([]byte) (*archiveMembers, error), files sopsFiles) ([]byte, error) {
+	archive, member, err := splitArchivePath(url.Path)
+	if err != nil {
+		return nil, err
+	}
+	if member != "" && url.Fragment != "" {
+		return nil, fmt.Errorf("'%s' addresses a member both by path and by fragment", url.String())
+	}
+	if member == "" {
+		member = url.Fragment
+	}
+	if member == "" {
+		return files.decrypt(archive)
+	}
+	members, err := openArchive(archive, open, files)
+	if err != nil {
+		return nil, err
+	}
+	return members.read(archive, member)
+}
+
+// splitArchivePath splits the path of an archive URI into the longest
+// existing prefix, the archive, and the path of a member within it. A path
+// below a directory rather than a file does not exist.
+func splitArchivePath(p string) (archive string, member string, err error) {
+	archive = filepath.Clean(p)
+	var rest []string
+	for {
+		info, err := os.Stat(archive)
+		if err == nil {
+			if len(rest) > 0 && info.IsDir() {
+				return "", "", &fs.PathError{Op: "stat", Path: p, Err: fs.ErrNotExist}
+			}
+			return archive, strings.Join(rest, "/"), nil
+		}
+		// Paths below an archive fail with ENOTDIR
+		if !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, syscall.ENOTDIR) {
+			return "", "", err
+		}
+		parent := filepath.Dir(archive)
+		if parent == archive {
+			return "", "", err
+		}
+		rest = append([]string{filepath.Base(archive)}, rest...)
+		archive = parent
+	}
+}
+
+func sortedElements(elements []pkl.PathElement) []pkl.PathElement {
+	slices.SortFunc(elements, func(a, b pkl.PathElement) int { return strings.Compare(a.Name(), b.Name()) })
+	return elements
+}
@@ -0,0 +1,202 @@
+package render
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/fs"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/apple/pkl-go/pkl"
+	"github.com/klauspost/compress/zstd"
+	"github.com/niule-eu/hlcli/pkg/framework"
+	testutils "github.com/niule-eu/hlcli/test"
+)
+
+var archiveContent = map[string]string{
+	"./tls.key":     "key",
+	"./tls.crt":     "crt",
+	"./ca/root.crt": "root",
+	"./ca/nested/x": "x",
+}
+
+func tarArchive(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, content := range archiveContent {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func zipArchive(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range archiveContent {
+		w, err := zw.Create(name[2:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func zstdCompressed(t *testing.T, content []byte) []byte {
+	t.Helper()
+	zw, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zw.Close()
+	return zw.EncodeAll(content, nil)
+}
+
+func gzipped(t *testing.T, content []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// encryptedArchive writes content encrypted with SOPS to name in the
+// directory of execEnv.
+func encryptedArchive(t *testing.T, execEnv *testutils.SopsExecEnvironment, name string, content []byte) string {
+	t.Helper()
+	path := filepath.Join(execEnv.Cwd, name)
+	err := framework.CompoundEffect{Effects: []framework.Effect{
+		framework.NewSopsEncryptEffect(&content, "", path, execEnv.EnvVars),
+		framework.NewDefaultFileWriteIO(path, &content),
+	}}.Apply()
+	if err != nil {
+		t.Fatalf("Encrypting %s failed: %v", name, err)
+	}
+	return path
+}
+
+func TestArchiveResourceReaders(t *testing.T) {
+	execEnv := testutils.NewSopsExecEnv(t)
+	for k, v := range execEnv.EnvVars {
+		t.Setenv(k, v)
+	}
+
+	type reader interface {
+		ListElements(url.URL) ([]pkl.PathElement, error)
+		Read(url.URL) ([]byte, error)
+	}
+	for name, tc := range map[string]struct {
+		reader  reader
+		scheme  string
+		archive string
+	}{
+		"tar":     {SopsTarResourceReader{}, "sopstar", encryptedArchive(t, execEnv, "certs.tar", tarArchive(t))},
+		"tar.gz":  {SopsTarResourceReader{}, "sopstar", encryptedArchive(t, execEnv, "certs.tar.gz", gzipped(t, tarArchive(t)))},
+		"tar.zst": {SopsTarResourceReader{}, "sopstar", encryptedArchive(t, execEnv, "certs.tar.zst", zstdCompressed(t, tarArchive(t)))},
+		"zip":     {SopsZipResourceReader{}, "sopszip", encryptedArchive(t, execEnv, "certs.zip", zipArchive(t))},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Run("lists members of a directory", func(t *testing.T) {
+				for path, expected := range map[string][]string{
+					tc.archive:         {"ca/", "tls.crt", "tls.key"},
+					tc.archive + "/ca": {"nested/", "root.crt"},
+				} {
+					elements, err := tc.reader.ListElements(url.URL{Scheme: tc.scheme, Path: path})
+					if err != nil {
+						t.Fatalf("ListElements(%s) failed: %v", path, err)
+					}
+					if got := elementNames(elements); !slices.Equal(got, expected) {
+						t.Errorf("ListElements(%s) = %v, expected %v", path, got, expected)
+					}
+				}
+			})
+
+			t.Run("reads members by path and by fragment", func(t *testing.T) {
+				for _, u := range []url.URL{
+					{Scheme: tc.scheme, Path: tc.archive + "/ca/root.crt"},
+					{Scheme: tc.scheme, Path: tc.archive, Fragment: "ca/root.crt"},
+					{Scheme: tc.scheme, Path: tc.archive, Fragment: "./ca/root.crt"},
+					{Scheme: tc.scheme, Path: tc.archive, Fragment: "/ca//root.crt"},
+				} {
+					content, err := tc.reader.Read(u)
+					if err != nil {
+						t.Fatalf("Read(%s) failed: %v", u.String(), err)
+					}
+					if string(content) != "root" {
+						t.Errorf("Read(%s) = %q, expected %q", u.String(), content, "root")
+					}
+				}
+			})
+
+			t.Run("reads directories as listings", func(t *testing.T) {
+				content, err := tc.reader.Read(url.URL{Scheme: tc.scheme, Path: tc.archive, Fragment: "ca"})
+				if err != nil {
+					t.Fatalf("Read failed: %v", err)
+				}
+				if string(content) != "nested/\nroot.crt\n" {
+					t.Errorf("Expected listing of ca, got %q", content)
+				}
+			})
+
+			t.Run("fails on missing members", func(t *testing.T) {
+				for _, u := range []url.URL{
+					{Scheme: tc.scheme, Path: tc.archive + "/missing"},
+					{Scheme: tc.scheme, Path: tc.archive, Fragment: "missing"},
+				} {
+					_, err := tc.reader.Read(u)
+					var notFound *ArchiveMemberNotFoundError
+					if !errors.As(err, &notFound) || !errors.Is(err, fs.ErrNotExist) {
+						t.Errorf("Read(%s): expected ArchiveMemberNotFoundError, got: %v", u.String(), err)
+					}
+				}
+			})
+		})
+	}
+
+	t.Run("lists archives of a local directory", func(t *testing.T) {
+		elements, err := SopsTarResourceReader{}.ListElements(url.URL{Scheme: "sopstar", Path: execEnv.Cwd})
+		if err != nil {
+			t.Fatalf("ListElements failed: %v", err)
+		}
+		if got := elementNames(elements); !slices.Contains(got, "certs.tar/") {
+			t.Errorf("Expected certs.tar listed as a directory, got %v", got)
+		}
+	})
+
+	t.Run("fails on paths below missing archives", func(t *testing.T) {
+		for _, p := range []string{
+			filepath.Join(execEnv.Cwd, "typo.tar", "tls.key"),
+			filepath.Join(execEnv.Cwd, "typo.tar"),
+		} {
+			_, err := SopsTarResourceReader{}.Read(url.URL{Scheme: "sopstar", Path: p})
+			if !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("Read(%s): expected fs.ErrNotExist, got: %v", p, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,116 @@
+package render
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/apple/pkl-go/pkl"
+	"github.com/getsops/sops/v3/decrypt"
+)
+
+// decryptCache holds the decrypted content of the SOPS-encrypted files read
+// by the resource readers of an evaluator, so that each file is decrypted
+// once per evaluation, not once per read. Entries are invalidated when the
+// modification time or size of their file changes. Parallel evaluations may
+// still read the content an entry held, so it is replaced, and only zeroed
+// once the cache is cleared. A nil *decryptCache decrypts on every read.
+type decryptCache struct {
+	mu      sync.Mutex
+	entries map[string]*decryptedFile
+}
+
+type decryptedFile struct {
+	mu         sync.Mutex // Held while decrypting, so that concurrent reads decrypt once
+	modTime    time.Time
+	size       int64
+	content    []byte
+	superseded [][]byte // Content of earlier versions of the file
+}
+
+func newDecryptCache() *decryptCache {
+	return &decryptCache{entries: map[string]*decryptedFile{}}
+}
+
+// decrypt returns the decrypted content of the file at path. The returned
+// slice is shared and must not be modified. It stays valid until the cache
+// is cleared, even if the file changes.
+func (c *decryptCache) decrypt(path string) ([]byte, error) {
+	if c == nil {
+		return decrypt.File(path, "binary")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if c.entries == nil {
+		c.entries = map[string]*decryptedFile{}
+	}
+	entry, ok := c.entries[path]
+	if !ok {
+		entry = &decryptedFile{}
+		c.entries[path] = entry
+	}
+	c.mu.Unlock()
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	if entry.content != nil && entry.modTime.Equal(info.ModTime()) && entry.size == info.Size() {
+		return entry.content, nil
+	}
+	content, err := decrypt.File(path, "binary")
+	if err != nil {
+		return nil, err
+	}
+	if entry.content != nil {
+		entry.superseded = append(entry.superseded, entry.content)
+	}
+	entry.content, entry.modTime, entry.size = content, info.ModTime(), info.Size()
+	return content, nil
+}
+
+// clear zeroes and drops every decrypted file, so it must not run while the
+// content is read.
+func (c *decryptCache) clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, entry := range c.entries {
+		entry.mu.Lock()
+		clear(entry.content)
+		for _, content := range entry.superseded {
+			clear(content)
+		}
+		entry.content, entry.superseded = nil, nil
+		entry.mu.Unlock()
+	}
+	c.entries = nil
+}
+
+// sopsFiles decrypts the files read by the resource readers of an
+// evaluator, recording and caching them.
+type sopsFiles struct {
+	reads *resourceReads
+	cache *decryptCache
+}
+
+func (f sopsFiles) decrypt(path string) ([]byte, error) {
+	f.reads.addFile(path)
+	return f.cache.decrypt(path)
+}
+
+// cachingEvaluator is an evaluator whose resource readers share a decryption
+// cache, cleared when the evaluator is closed.
+type cachingEvaluator struct {
+	pkl.Evaluator
+	cache *decryptCache
+}
+
+func (e *cachingEvaluator) Close() error {
+	defer e.cache.clear()
+	return e.Evaluator.Close()
+}
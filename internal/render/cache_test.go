@@ -0,0 +1,104 @@
+package render
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	testutils "github.com/niule-eu/hlcli/test"
+)
+
+func TestDecryptCache(t *testing.T) {
+	execEnv := testutils.NewSopsExecEnv(t)
+	for k, v := range execEnv.EnvVars {
+		t.Setenv(k, v)
+	}
+	path := encryptedArchive(t, execEnv, "secret.bin", []byte("first"))
+	cache := newDecryptCache()
+
+	first, err := cache.decrypt(path)
+	if err != nil {
+		t.Fatalf("decrypt failed: %v", err)
+	}
+	again, err := cache.decrypt(path)
+	if err != nil {
+		t.Fatalf("decrypt failed: %v", err)
+	}
+	if string(again) != "first" || &again[0] != &first[0] {
+		t.Errorf("Expected the cached content, got %q", again)
+	}
+
+	t.Run("decrypts files again once they change", func(t *testing.T) {
+		encryptedArchive(t, execEnv, "secret.bin", []byte("second"))
+		later := time.Now().Add(time.Minute)
+		if err := os.Chtimes(path, later, later); err != nil {
+			t.Fatal(err)
+		}
+		content, err := cache.decrypt(path)
+		if err != nil {
+			t.Fatalf("decrypt failed: %v", err)
+		}
+		if string(content) != "second" {
+			t.Errorf("Expected the new content, got %q", content)
+		}
+	})
+
+	t.Run("keeps the content read before a change", func(t *testing.T) {
+		var read, done sync.WaitGroup
+		changed := make(chan struct{})
+		for range 8 {
+			read.Add(1)
+			done.Add(1)
+			go func() {
+				defer done.Done()
+				content, err := cache.decrypt(path)
+				read.Done()
+				if err != nil {
+					t.Errorf("decrypt failed: %v", err)
+					return
+				}
+				<-changed
+				if _, err := cache.decrypt(path); err != nil {
+					t.Errorf("decrypt failed: %v", err)
+				}
+				if string(content) != "second" {
+					t.Errorf("Expected the content read before the change, got %q", content)
+				}
+			}()
+		}
+		read.Wait()
+		encryptedArchive(t, execEnv, "secret.bin", []byte("third"))
+		later := time.Now().Add(2 * time.Minute)
+		if err := os.Chtimes(path, later, later); err != nil {
+			t.Fatal(err)
+		}
+		close(changed)
+		done.Wait()
+	})
+
+	t.Run("zeroes content when cleared", func(t *testing.T) {
+		earlier, err := cache.decrypt(path)
+		if err != nil {
+			t.Fatalf("decrypt failed: %v", err)
+		}
+		encryptedArchive(t, execEnv, "secret.bin", []byte("fourth"))
+		later := time.Now().Add(3 * time.Minute)
+		if err := os.Chtimes(path, later, later); err != nil {
+			t.Fatal(err)
+		}
+		content, err := cache.decrypt(path)
+		if err != nil {
+			t.Fatalf("decrypt failed: %v", err)
+		}
+		if string(earlier) == string(content) {
+			t.Fatalf("Expected the file to be decrypted again, got %q", content)
+		}
+		cache.clear()
+		for _, b := range append(earlier, content...) {
+			if b != 0 {
+				t.Fatalf("Expected zeroed content, got %q and %q", earlier, content)
+			}
+		}
+	})
+}
@@ -0,0 +1,141 @@
+package render
+
+import (
+	"bufio"
+	"fmt"
+	"maps"
+	"os"
+	"strings"
+
+	"github.com/knadh/koanf/v2"
+)
+
+// UnknownExternalValueError is returned when an external property or
+// environment variable refers to a configuration key or secret that is not
+// set.
+type UnknownExternalValueError struct {
+	Name   string
+	Source string
+	Key    string
+}
+
+func (e *UnknownExternalValueError) Error() string {
+	return fmt.Sprintf("'%s' refers to %s '%s', which is not set", e.Name, e.Source, e.Key)
+}
+
+// ParseExternalValues parses NAME=VALUE assignments, as given to
+// `render-pkl -p`. Later assignments of a name win.
+func ParseExternalValues(assignments []string) (map[string]string, error) {
+	values := map[string]string{}
+	for _, a := range assignments {
+		name, value, ok := strings.Cut(a, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("expected NAME=VALUE, got '%s'", a)
+		}
+		values[name] = value
+	}
+	return values, nil
+}
+
+// ResolveExternalValues resolves NAME=SOURCE:KEY references, where SOURCE is
+// config for a key of cliConfig or secret for a key of secrets.
+func ResolveExternalValues(references []string, cliConfig *koanf.Koanf, secrets *koanf.Koanf) (map[string]string, error) {
+	refs, err := ParseExternalValues(references)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]string{}
+	for name, ref := range refs {
+		source, key, _ := strings.Cut(ref, ":")
+		var k *koanf.Koanf
+		switch source {
+		case "config":
+			k = cliConfig
+		case "secret":
+			k = secrets
+		default:
+			return nil, fmt.Errorf("'%s': expected config:KEY or secret:KEY, got '%s'", name, ref)
+		}
+		if key == "" || !k.Exists(key) {
+			return nil, &UnknownExternalValueError{Name: name, Source: source, Key: key}
+		}
+		values[name] = fmt.Sprint(k.Get(key))
+	}
+	return values, nil
+}
+
+// ReadEnvFile reads the variables of a dotenv file: NAME=VALUE lines,
+// optionally prefixed by `export`, with values optionally quoted. Blank lines
+// and lines starting with # are ignored.
+func ReadEnvFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	env := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		name, value, ok := strings.Cut(line, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%s:%d: expected NAME=VALUE", path, n)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		env[name] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+// environ returns the environment of hlcli by name.
+func environ() map[string]string {
+	env := map[string]string{}
+	for _, v := range os.Environ() {
+		if name, value, ok := strings.Cut(v, "="); ok {
+			env[name] = value
+		}
+	}
+	return env
+}
+
+// WithProperties returns s with values added to its external properties,
+// read through prop:, replacing those of the same name.
+func (s EvaluatorSettings) WithProperties(values map[string]string) EvaluatorSettings {
+	if len(values) == 0 {
+		return s
+	}
+	properties := maps.Clone(s.Properties)
+	if properties == nil {
+		properties = map[string]string{}
+	}
+	maps.Copy(properties, values)
+	s.Properties = properties
+	return s
+}
+
+// WithEnv returns s with values added to the environment read through env:,
+// which is the environment of hlcli unless s.Env is set.
+func (s EvaluatorSettings) WithEnv(values map[string]string) EvaluatorSettings {
+	if len(values) == 0 {
+		return s
+	}
+	env := maps.Clone(s.Env)
+	if env == nil {
+		env = environ()
+	}
+	maps.Copy(env, values)
+	s.Env = env
+	return s
+}
@@ -0,0 +1,102 @@
+package render
+
+import (
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/knadh/koanf/v2"
+)
+
+func TestExternalValues(t *testing.T) {
+	t.Run("parses assignments", func(t *testing.T) {
+		values, err := ParseExternalValues([]string{"env=prod", "url=https://a?b=c", "empty=", "env=staging"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := map[string]string{"env": "staging", "url": "https://a?b=c", "empty": ""}
+		if !maps.Equal(values, expected) {
+			t.Errorf("expected %v, got %v", expected, values)
+		}
+		for _, invalid := range []string{"env", "=prod"} {
+			if _, err := ParseExternalValues([]string{invalid}); err == nil {
+				t.Errorf("%s: expected an error", invalid)
+			}
+		}
+	})
+
+	t.Run("resolves configuration keys and secrets", func(t *testing.T) {
+		cliConfig := koanf.New(".")
+		cliConfig.Set("deploy.region", "eu-west-1")
+		cliConfig.Set("deploy.replicas", 3)
+		secrets := koanf.New(".")
+		secrets.Set("db.password", "hunter2")
+
+		values, err := ResolveExternalValues([]string{
+			"region=config:deploy.region",
+			"replicas=config:deploy.replicas",
+			"password=secret:db.password",
+		}, cliConfig, secrets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := map[string]string{"region": "eu-west-1", "replicas": "3", "password": "hunter2"}
+		if !maps.Equal(values, expected) {
+			t.Errorf("expected %v, got %v", expected, values)
+		}
+
+		_, err = ResolveExternalValues([]string{"password=secret:db.user"}, cliConfig, secrets)
+		var unknown *UnknownExternalValueError
+		if !errors.As(err, &unknown) || unknown.Source != "secret" || unknown.Key != "db.user" {
+			t.Errorf("expected UnknownExternalValueError, got %v", err)
+		}
+		if _, err := ResolveExternalValues([]string{"region=env:REGION"}, cliConfig, secrets); err == nil {
+			t.Error("expected an error for an unknown source")
+		}
+	})
+
+	t.Run("reads env files", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "prod.env")
+		content := "# production\nSTAGE=prod\n\nexport REGION = \"eu west\"\nTOKEN='a=b'\n"
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		env, err := ReadEnvFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := map[string]string{"STAGE": "prod", "REGION": "eu west", "TOKEN": "a=b"}
+		if !maps.Equal(env, expected) {
+			t.Errorf("expected %v, got %v", expected, env)
+		}
+
+		if err := os.WriteFile(path, []byte("STAGE\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadEnvFile(path); err == nil {
+			t.Error("expected an error for a line without =")
+		}
+	})
+
+	t.Run("layers values over the settings", func(t *testing.T) {
+		t.Setenv("HLCLI_TEST_STAGE", "dev")
+		settings := EvaluatorSettings{Properties: map[string]string{"env": "dev", "region": "eu"}}
+		layered := settings.WithProperties(map[string]string{"env": "prod"}).WithEnv(map[string]string{"REGION": "eu"})
+		if !maps.Equal(layered.Properties, map[string]string{"env": "prod", "region": "eu"}) {
+			t.Errorf("unexpected properties %v", layered.Properties)
+		}
+		if settings.Properties["env"] != "dev" {
+			t.Error("the properties of the original settings changed")
+		}
+		if layered.Env["REGION"] != "eu" || layered.Env["HLCLI_TEST_STAGE"] != "dev" {
+			t.Errorf("expected the environment of hlcli with REGION, got %v", layered.Env)
+		}
+
+		restricted := EvaluatorSettings{Env: map[string]string{"STAGE": "prod"}}.WithEnv(map[string]string{"REGION": "eu"})
+		if !maps.Equal(restricted.Env, map[string]string{"STAGE": "prod", "REGION": "eu"}) {
+			t.Errorf("expected only the configured environment, got %v", restricted.Env)
+		}
+	})
+}
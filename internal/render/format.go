@@ -0,0 +1,381 @@
+package render
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/apple/pkl-go/pkl"
+	"github.com/niule-eu/hlcli/pkg/framework"
+)
+
+// UnknownFormatError is returned when an output format is not one of
+// OutputFormats.
+type UnknownFormatError struct {
+	Format string
+}
+
+func (e *UnknownFormatError) Error() string {
+	return fmt.Sprintf("Unknown output format '%s', expected one of %s", e.Format, strings.Join(OutputFormats(), ", "))
+}
+
+// outputFormat renders values with a Pkl renderer, or converts their JSON
+// rendering for formats Pkl has no renderer of its own for.
+type outputFormat struct {
+	ext      string // Extension of the output of each format when rendering several
+	renderer string // Pkl expression of the renderer, a JsonRenderer if convert is set
+	convert  func(value any) ([]byte, error)
+}
+
+var outputFormats = map[string]outputFormat{
+	"yaml":        {ext: ".yaml", renderer: "new YamlRenderer {}"},
+	"json":        {ext: ".json", renderer: "new JsonRenderer {}"},
+	"plist":       {ext: ".plist", renderer: "new PListRenderer {}"},
+	"properties":  {ext: ".properties", renderer: "new PropertiesRenderer {}"},
+	"jsonnet":     {ext: ".jsonnet", renderer: `import("hlcli:/formats.pkl").jsonnet`},
+	"toml":        {ext: ".toml", renderer: "new JsonRenderer {}", convert: renderToml},
+	"hcl":         {ext: ".tfvars", renderer: "new JsonRenderer {}", convert: renderHcl},
+	"tfvars.json": {ext: ".tfvars.json", renderer: "new JsonRenderer {}"},
+}
+
+// OutputFormats returns the names of the formats of RenderPklParams.Formats.
+func OutputFormats() []string {
+	var names []string
+	for name := range outputFormats {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// formatOutputPath returns the file the output of format is written to. With
+// several formats, the extension of output, the longest one of a format if
+// any, is replaced by the one of each.
+func formatOutputPath(output string, format string, several bool) (string, error) {
+	if !several {
+		return output, nil
+	}
+	if strings.HasPrefix(output, "/dev/") {
+		return "", fmt.Errorf("rendering several formats requires an output file, not %s", output)
+	}
+	ext := filepath.Ext(output)
+	for _, f := range outputFormats {
+		if len(f.ext) > len(ext) && strings.HasSuffix(output, f.ext) {
+			ext = f.ext
+		}
+	}
+	return strings.TrimSuffix(output, ext) + outputFormats[format].ext, nil
+}
+
+// renderFormats renders the value of output, or of the expression of params,
+// in each of params.Formats, ignoring the renderer of the module.
+func renderFormats(ctx context.Context, evaluator pkl.Evaluator, source *pkl.ModuleSource, params RenderPklParams) ([]framework.Effect, error) {
+	if params.MultipleFileOutput {
+		return nil, errors.New("output formats cannot be combined with output.files")
+	}
+	value := "output.value"
+	if params.Expression != "" {
+		value = "(" + params.Expression + ")"
+	}
+	var formats []string
+	for _, name := range params.Formats {
+		if !slices.Contains(formats, name) {
+			formats = append(formats, name)
+		}
+	}
+	var effects []framework.Effect
+	for _, name := range formats {
+		format, ok := outputFormats[name]
+		if !ok {
+			return nil, &UnknownFormatError{Format: name}
+		}
+		path, err := formatOutputPath(params.OutputFile, name, len(formats) > 1)
+		if err != nil {
+			return nil, err
+		}
+		var rendered string
+		expression := fmt.Sprintf("%s.renderDocument(%s)", format.renderer, value)
+		if err := evaluator.EvaluateExpression(ctx, source, expression, &rendered); err != nil {
+			return nil, err
+		}
+		content := []byte(rendered)
+		if format.convert != nil {
+			decoded, err := decodeOrderedJson(content)
+			if err != nil {
+				return nil, err
+			}
+			if content, err = format.convert(decoded); err != nil {
+				return nil, fmt.Errorf("rendering %s as %s: %w", params.moduleName(), name, err)
+			}
+		}
+		effects = append(effects, framework.NewDefaultFileWriteIO(path, &content))
+	}
+	return effects, nil
+}
+
+// member is a property of a JSON object, objects keep the order Pkl renders
+// their properties in.
+type member struct {
+	key   string
+	value any
+}
+
+type object []member
+
+// decodeOrderedJson decodes data into object, []any, string, json.Number,
+// bool and nil values.
+func decodeOrderedJson(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	value, err := decodeJsonValue(dec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("unexpected data after JSON value")
+	}
+	return value, nil
+}
+
+func decodeJsonValue(dec *json.Decoder) (any, error) {
+	token, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch token {
+	case json.Delim('{'):
+		obj := object{}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := decodeJsonValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			obj = append(obj, member{key: key.(string), value: value})
+		}
+		_, err := dec.Token()
+		return obj, err
+	case json.Delim('['):
+		list := []any{}
+		for dec.More() {
+			value, err := decodeJsonValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		_, err := dec.Token()
+		return list, err
+	default:
+		return token, nil
+	}
+}
+
+// escapeString escapes s as a string literal delimited by quote, in the
+// syntax shared by TOML and HCL.
+func escapeString(s string, quote rune) string {
+	var b strings.Builder
+	b.WriteRune(quote)
+	for _, r := range s {
+		switch {
+		case r == quote || r == '\\':
+			b.WriteRune('\\')
+			b.WriteRune(r)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&b, `\u%04X`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteRune(quote)
+	return b.String()
+}
+
+var (
+	tomlBareKey   = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	hclIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]*$`)
+)
+
+// renderToml renders an object as a TOML document. Nested objects become
+// tables and lists of objects arrays of tables, null properties are left out.
+func renderToml(value any) ([]byte, error) {
+	obj, ok := value.(object)
+	if !ok {
+		return nil, errors.New("a TOML document must be an object")
+	}
+	var b strings.Builder
+	if err := writeTomlTable(&b, nil, obj); err != nil {
+		return nil, err
+	}
+	return []byte(strings.TrimPrefix(b.String(), "\n")), nil
+}
+
+func isTableArray(value any) bool {
+	list, ok := value.([]any)
+	return ok && len(list) > 0 && !slices.ContainsFunc(list, func(v any) bool {
+		_, ok := v.(object)
+		return !ok
+	})
+}
+
+func writeTomlTable(b *strings.Builder, path []string, obj object) error {
+	for _, m := range obj {
+		if _, ok := m.value.(object); ok || m.value == nil || isTableArray(m.value) {
+			continue
+		}
+		value, err := tomlValue(m.value)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(b, "%s = %s\n", tomlKey(m.key), value)
+	}
+	for _, m := range obj {
+		tablePath := append(slices.Clone(path), m.key)
+		if table, ok := m.value.(object); ok {
+			fmt.Fprintf(b, "\n[%s]\n", tomlPath(tablePath))
+			if err := writeTomlTable(b, tablePath, table); err != nil {
+				return err
+			}
+		} else if isTableArray(m.value) {
+			for _, table := range m.value.([]any) {
+				fmt.Fprintf(b, "\n[[%s]]\n", tomlPath(tablePath))
+				if err := writeTomlTable(b, tablePath, table.(object)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func tomlKey(key string) string {
+	if tomlBareKey.MatchString(key) {
+		return key
+	}
+	return escapeString(key, '"')
+}
+
+func tomlPath(path []string) string {
+	keys := make([]string, len(path))
+	for i, key := range path {
+		keys[i] = tomlKey(key)
+	}
+	return strings.Join(keys, ".")
+}
+
+// tomlValue renders value inline.
+func tomlValue(value any) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", errors.New("TOML has no null values")
+	case string:
+		return escapeString(v, '"'), nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return fmt.Sprint(v), nil
+	case []any:
+		values := make([]string, len(v))
+		for i, e := range v {
+			s, err := tomlValue(e)
+			if err != nil {
+				return "", err
+			}
+			values[i] = s
+		}
+		return "[" + strings.Join(values, ", ") + "]", nil
+	case object:
+		var values []string
+		for _, m := range v {
+			if m.value == nil {
+				continue
+			}
+			s, err := tomlValue(m.value)
+			if err != nil {
+				return "", err
+			}
+			values = append(values, tomlKey(m.key)+" = "+s)
+		}
+		if len(values) == 0 {
+			return "{}", nil
+		}
+		return "{ " + strings.Join(values, ", ") + " }", nil
+	}
+	return "", fmt.Errorf("unexpected value %v", value)
+}
+
+// renderHcl renders an object as HCL attributes, the syntax of OpenTofu and
+// Terraform variable files (.tfvars).
+func renderHcl(value any) ([]byte, error) {
+	obj, ok := value.(object)
+	if !ok {
+		return nil, errors.New("HCL variables must be the properties of an object")
+	}
+	var b strings.Builder
+	for _, m := range obj {
+		if !hclIdentifier.MatchString(m.key) {
+			return nil, fmt.Errorf("'%s' is not a valid HCL attribute name", m.key)
+		}
+		b.WriteString(m.key + " = ")
+		writeHclValue(&b, m.value, "")
+		b.WriteString("\n")
+	}
+	return []byte(b.String()), nil
+}
+
+func writeHclValue(b *strings.Builder, value any, indent string) {
+	switch v := value.(type) {
+	case nil:
+		b.WriteString("null")
+	case string:
+		// Template sequences are escaped by doubling their introducer
+		s := strings.NewReplacer("${", "$${", "%{", "%%{").Replace(v)
+		b.WriteString(escapeString(s, '"'))
+	case []any:
+		if len(v) == 0 {
+			b.WriteString("[]")
+			return
+		}
+		b.WriteString("[\n")
+		for _, e := range v {
+			b.WriteString(indent + "  ")
+			writeHclValue(b, e, indent+"  ")
+			b.WriteString(",\n")
+		}
+		b.WriteString(indent + "]")
+	case object:
+		if len(v) == 0 {
+			b.WriteString("{}")
+			return
+		}
+		b.WriteString("{\n")
+		for _, m := range v {
+			key := m.key
+			if !hclIdentifier.MatchString(key) {
+				key = escapeString(key, '"')
+			}
+			b.WriteString(indent + "  " + key + " = ")
+			writeHclValue(b, m.value, indent+"  ")
+			b.WriteString("\n")
+		}
+		b.WriteString(indent + "}")
+	default:
+		fmt.Fprint(b, v)
+	}
+}
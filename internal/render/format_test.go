@@ -0,0 +1,258 @@
+package render
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/apple/pkl-go/pkl"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	hcljson "github.com/hashicorp/hcl/v2/json"
+	"github.com/niule-eu/hlcli/pkg/framework"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
+)
+
+const formatTestJson = `{
+  "name": "web",
+  "replicas": 3,
+  "enabled": true,
+  "ratio": 0.5,
+  "comment": null,
+  "tags": ["a", "b"],
+  "db": {"host": "db.local", "port": 5432, "options": {"ssl mode": "require"}},
+  "routes": [{"path": "/", "template": "${host}\n"}, {"path": "/api", "template": "%{if x}"}]
+}`
+
+func TestOutputFormatConversions(t *testing.T) {
+	value, err := decodeOrderedJson([]byte(formatTestJson))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		format   string
+		expected string
+	}{
+		{format: "toml", expected: `name = "web"
+replicas = 3
+enabled = true
+ratio = 0.5
+tags = ["a", "b"]
+
+[db]
+host = "db.local"
+port = 5432
+
+[db.options]
+"ssl mode" = "require"
+
+[[routes]]
+path = "/"
+template = "${host}\n"
+
+[[routes]]
+path = "/api"
+template = "%{if x}"
+`},
+		{format: "hcl", expected: `name = "web"
+replicas = 3
+enabled = true
+ratio = 0.5
+comment = null
+tags = [
+  "a",
+  "b",
+]
+db = {
+  host = "db.local"
+  port = 5432
+  options = {
+    "ssl mode" = "require"
+  }
+}
+routes = [
+  {
+    path = "/"
+    template = "$${host}\n"
+  },
+  {
+    path = "/api"
+    template = "%%{if x}"
+  },
+]
+`},
+	} {
+		t.Run(tc.format, func(t *testing.T) {
+			content, err := outputFormats[tc.format].convert(value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != tc.expected {
+				t.Errorf("Expected:\n%s\ngot:\n%s", tc.expected, content)
+			}
+		})
+	}
+
+	t.Run("rejects values the format cannot hold", func(t *testing.T) {
+		for format, data := range map[string]string{
+			"toml": `[1, 2]`,
+			"hcl":  `{"not an attribute": 1}`,
+		} {
+			value, err := decodeOrderedJson([]byte(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := outputFormats[format].convert(value); err == nil {
+				t.Errorf("%s: expected an error for %s", format, data)
+			}
+		}
+		value, err := decodeOrderedJson([]byte(`{"list": [1, null]}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := renderToml(value); err == nil {
+			t.Error("expected an error for null in a TOML array")
+		}
+	})
+}
+
+// hclAttributes evaluates the attributes of a variable file as JSON values.
+func hclAttributes(t *testing.T, file *hcl.File, diags hcl.Diagnostics) map[string]any {
+	t.Helper()
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	attrs, diags := file.Body.JustAttributes()
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	values := map[string]any{}
+	for name, attr := range attrs {
+		value, diags := attr.Expr.Value(nil)
+		if diags.HasErrors() {
+			t.Fatal(diags)
+		}
+		data, err := ctyjson.Marshal(value, value.Type())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded any
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		values[name] = decoded
+	}
+	return values
+}
+
+// The variable files are read as OpenTofu and Terraform read them, which the
+// terraform binary is not needed for.
+func TestVariableFilesRoundTrip(t *testing.T) {
+	var expected map[string]any
+	if err := json.Unmarshal([]byte(formatTestJson), &expected); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("hcl", func(t *testing.T) {
+		value, err := decodeOrderedJson([]byte(formatTestJson))
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := renderHcl(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file, diags := hclsyntax.ParseConfig(content, "test.tfvars", hcl.InitialPos)
+		if actual := hclAttributes(t, file, diags); !reflect.DeepEqual(actual, expected) {
+			t.Errorf("Expected %v, got %v", expected, actual)
+		}
+	})
+
+	t.Run("tfvars.json", func(t *testing.T) {
+		// Rendered by JsonRenderer as is
+		file, diags := hcljson.Parse([]byte(formatTestJson), "test.tfvars.json")
+		if actual := hclAttributes(t, file, diags); !reflect.DeepEqual(actual, expected) {
+			t.Errorf("Expected %v, got %v", expected, actual)
+		}
+	})
+}
+
+func TestFormatOutputPath(t *testing.T) {
+	for _, tc := range []struct {
+		output   string
+		format   string
+		several  bool
+		expected string
+	}{
+		{output: "/dev/stdout", format: "toml", expected: "/dev/stdout"},
+		{output: "out/prod.auto.tfvars", format: "hcl", expected: "out/prod.auto.tfvars"},
+		{output: "out/values.yaml", format: "json", several: true, expected: "out/values.json"},
+		{output: "out/values", format: "hcl", several: true, expected: "out/values.tfvars"},
+		{output: "out/values.yaml", format: "tfvars.json", several: true, expected: "out/values.tfvars.json"},
+		{output: "out/values.tfvars.json", format: "yaml", several: true, expected: "out/values.yaml"},
+	} {
+		path, err := formatOutputPath(tc.output, tc.format, tc.several)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if path != tc.expected {
+			t.Errorf("%s as %s: expected %s, got %s", tc.output, tc.format, tc.expected, path)
+		}
+	}
+	if _, err := formatOutputPath("/dev/stdout", "json", true); err == nil {
+		t.Error("expected an error for several formats on stdout")
+	}
+}
+
+// renderingEvaluator records the expressions it evaluates and renders them
+// all as JSON objects.
+type renderingEvaluator struct {
+	pkl.Evaluator
+	expressions *[]string
+}
+
+func (e renderingEvaluator) EvaluateExpression(ctx context.Context, source *pkl.ModuleSource, expr string, out any) error {
+	*e.expressions = append(*e.expressions, expr)
+	*out.(*string) = `{"a": 1}`
+	return nil
+}
+
+func TestRenderFormats(t *testing.T) {
+	var expressions []string
+	evaluator := renderingEvaluator{expressions: &expressions}
+	params := RenderPklParams{
+		PklFile:    "/srv/app.pkl",
+		OutputFile: "/srv/out/app.yaml",
+		Expression: "config",
+		Formats:    []string{"yaml", "toml", "yaml", "jsonnet"},
+	}
+	effects, err := renderModule(context.Background(), evaluator, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, a := range framework.Plan(effects...) {
+		paths = append(paths, a.Path)
+	}
+	if !slices.Equal(paths, []string{"/srv/out/app.yaml", "/srv/out/app.toml", "/srv/out/app.jsonnet"}) {
+		t.Errorf("unexpected outputs %v", paths)
+	}
+	expected := []string{
+		"new YamlRenderer {}.renderDocument((config))",
+		"new JsonRenderer {}.renderDocument((config))",
+		`import("hlcli:/formats.pkl").jsonnet.renderDocument((config))`,
+	}
+	if !slices.Equal(expressions, expected) {
+		t.Errorf("expected expressions %v, got %v", expected, expressions)
+	}
+
+	params.Formats = []string{"xml"}
+	var unknown *UnknownFormatError
+	if _, err := renderModule(context.Background(), evaluator, params); !errors.As(err, &unknown) {
+		t.Errorf("expected UnknownFormatError, got %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+package render
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/apple/pkl-go/pkl"
+	"github.com/niule-eu/hlcli/pkg/framework"
+)
+
+// LibraryVersion is the version of the hlcli Pkl package embedded in the
+// binary, see pkl/PklProject.
+const LibraryVersion = "0.1.0"
+
+//go:embed pkl/*.pkl pkl/PklProject
+var library embed.FS
+
+// HlcliModuleReader serves the modules of the embedded hlcli Pkl package,
+// e.g. `import "hlcli:/secrets.pkl"`, so that modules rendered by hlcli
+// resolve them without network access.
+type HlcliModuleReader struct{}
+
+func (r HlcliModuleReader) Scheme() string { return "hlcli" }
+
+func (r HlcliModuleReader) IsGlobbable() bool { return false }
+
+func (r HlcliModuleReader) HasHierarchicalUris() bool { return true }
+
+func (r HlcliModuleReader) IsLocal() bool { return false }
+
+func (r HlcliModuleReader) ListElements(url url.URL) ([]pkl.PathElement, error) { return nil, nil }
+
+func (r HlcliModuleReader) Read(url url.URL) (string, error) {
+	content, err := library.ReadFile("pkl/" + strings.TrimPrefix(url.Path, "/"))
+	if err != nil {
+		return "", fmt.Errorf("no hlcli module %s: %w", url.String(), err)
+	}
+	return string(content), nil
+}
+
+// LibraryEffects returns the effects writing the embedded hlcli Pkl package
+// to dir, for tools evaluating modules without hlcli.
+func LibraryEffects(dir string) ([]framework.Effect, error) {
+	entries, err := fs.ReadDir(library, "pkl")
+	if err != nil {
+		return nil, err
+	}
+	var effects []framework.Effect
+	for _, entry := range entries {
+		content, err := library.ReadFile("pkl/" + entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		effects = append(effects, framework.NewDefaultFileWriteIO(filepath.Join(dir, entry.Name()), &content))
+	}
+	return effects, nil
+}
+
+// sopsFilesExpression renders the `sopsFiles` property of a module, see
+// pkl/sops.pkl, as a JSON object. Modules without it have no files to encrypt.
+const sopsFilesExpression = `new JsonRenderer {}.renderValue(module.getPropertyOrNull("sopsFiles") ?? new Mapping {})`
+
+// sopsFileRules returns the encryption requested by the module for entries
+// of output.files, by key. Every key must be one of files.
+func sopsFileRules(
+	ctx context.Context,
+	evaluator pkl.Evaluator,
+	source *pkl.ModuleSource,
+	module string,
+	files map[string][]byte,
+) (map[string]*framework.SopsRule, error) {
+	var rendered string
+	if err := evaluator.EvaluateExpression(ctx, source, sopsFilesExpression, &rendered); err != nil {
+		return nil, err
+	}
+	var rules map[string]*framework.SopsRule
+	if err := json.Unmarshal([]byte(rendered), &rules); err != nil {
+		return nil, fmt.Errorf("reading sopsFiles of %s: %w", module, err)
+	}
+	for key := range rules {
+		if _, ok := files[key]; !ok {
+			return nil, fmt.Errorf("sopsFiles of %s lists '%s', which is not a key of output.files", module, key)
+		}
+	}
+	return rules, nil
+}
@@ -0,0 +1,65 @@
+package render
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHlcliModuleReader(t *testing.T) {
+	reader := HlcliModuleReader{}
+
+	t.Run("reads embedded modules", func(t *testing.T) {
+		content, err := reader.Read(url.URL{Scheme: "hlcli", Path: "/sops.pkl"})
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		if !strings.Contains(content, "module hlcli.sops") {
+			t.Errorf("Expected the sops module, got: %s", content)
+		}
+	})
+
+	t.Run("reads every module of the package", func(t *testing.T) {
+		for _, module := range []string{"config.pkl", "formats.pkl", "render.pkl", "secrets.pkl", "sops.pkl"} {
+			if _, err := reader.Read(url.URL{Scheme: "hlcli", Path: "/" + module}); err != nil {
+				t.Errorf("Read of %s failed: %v", module, err)
+			}
+		}
+	})
+
+	t.Run("fails on unknown modules", func(t *testing.T) {
+		if _, err := reader.Read(url.URL{Scheme: "hlcli", Path: "/missing.pkl"}); err == nil {
+			t.Error("Expected error, got nil")
+		}
+	})
+}
+
+func TestLibraryVersion(t *testing.T) {
+	project, err := library.ReadFile("pkl/PklProject")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(project), `version = "`+LibraryVersion+`"`) {
+		t.Errorf("Expected PklProject to declare version %s", LibraryVersion)
+	}
+}
+
+func TestLibraryEffects(t *testing.T) {
+	dir := t.TempDir()
+	effects, err := LibraryEffects(dir)
+	if err != nil {
+		t.Fatalf("LibraryEffects failed: %v", err)
+	}
+	for _, effect := range effects {
+		if err := effect.Apply(); err != nil {
+			t.Fatalf("Effect execution failed: %v", err)
+		}
+	}
+	for _, name := range []string{"PklProject", "secrets.pkl", "sops.pkl"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("Expected %s to be written: %v", name, err)
+		}
+	}
+}
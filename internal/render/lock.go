@@ -0,0 +1,193 @@
+package render
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/niule-eu/hlcli/pkg/framework"
+)
+
+// renderLock records the files generated from a module in multi-file mode,
+// so that files the module stops producing can be pruned safely.
+type renderLock struct {
+	Module string       `json:"module"`
+	Files  []lockedFile `json:"files"`
+}
+
+type lockedFile struct {
+	Path   string `json:"path"` // Relative to the module directory, unless outside of it
+	SHA256 string `json:"sha256"`
+}
+
+// LockFilePath returns the path of the lock file of the module at pklFile.
+func LockFilePath(pklFile string) string {
+	return pklFile + ".lock"
+}
+
+func readRenderLock(path string) (*renderLock, error) {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &renderLock{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var lock renderLock
+	if err := json.Unmarshal(content, &lock); err != nil {
+		return nil, fmt.Errorf("reading lock file %s: %w", path, err)
+	}
+	return &lock, nil
+}
+
+func fileHash(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// lockEffects adds to the effects of a multi-file render of params.PklFile
+// the effect writing its lock file, once every output has been written.
+// Files recorded by the previous lock and no longer produced are deleted if
+// params.Prune is set and they still have the content that was generated.
+// Otherwise they remain recorded, so that a later prune can remove them.
+// As the lock file may have been edited, files are only deleted where the
+// module may write, see outputPath.
+func lockEffects(params RenderPklParams, effects []framework.Effect) ([]framework.Effect, error) {
+	pklFile := params.PklFile
+	moduleDir := filepath.Dir(pklFile)
+	lockPath := LockFilePath(pklFile)
+	previous, err := readRenderLock(lockPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var outputs []string
+	for _, a := range framework.Plan(effects...) {
+		if a.Kind == framework.ActionWrite {
+			outputs = append(outputs, filepath.Clean(a.Path))
+		}
+	}
+
+	var kept []lockedFile
+	var deletes []framework.Effect
+	for _, f := range previous.Files {
+		path := f.Path
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(moduleDir, path)
+		}
+		if slices.Contains(outputs, path) {
+			continue
+		}
+		if !params.Prune {
+			kept = append(kept, f)
+			continue
+		}
+		if abs, err := filepath.Abs(path); err != nil {
+			return nil, err
+		} else if _, err := outputPath(params, abs); err != nil {
+			return nil, err
+		}
+		hash, err := fileHash(path)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+		case err != nil:
+			return nil, err
+		case hash != f.SHA256:
+			log.Printf("Not pruning %s, it changed since it was generated", path)
+		default:
+			deletes = append(deletes, &framework.FileDeleteIO{Path: path, Op: os.Remove})
+		}
+	}
+
+	// Dependencies are matched by identity, which CompoundEffect values
+	// do not have
+	for i, e := range effects {
+		effects[i] = framework.After(e)
+	}
+	lock := &lockFileEffect{
+		path:      lockPath,
+		module:    filepath.Base(pklFile),
+		moduleDir: moduleDir,
+		outputs:   outputs,
+		kept:      kept,
+	}
+	effects = append(effects, deletes...)
+	return append(effects, framework.After(lock, effects...)), nil
+}
+
+// lockFileEffect writes the lock file of a module, recording the hashes of
+// its outputs as found on disk, after encryption.
+type lockFileEffect struct {
+	path      string
+	module    string
+	moduleDir string
+	outputs   []string
+	kept      []lockedFile
+}
+
+func (e *lockFileEffect) content() ([]byte, error) {
+	lock := renderLock{Module: e.module, Files: slices.Clone(e.kept)}
+	for _, p := range e.outputs {
+		hash, err := fileHash(p)
+		if err != nil {
+			return nil, err
+		}
+		if isWithin(e.moduleDir, p) {
+			p, _ = filepath.Rel(e.moduleDir, p)
+		}
+		lock.Files = append(lock.Files, lockedFile{Path: p, SHA256: hash})
+	}
+	slices.SortFunc(lock.Files, func(a, b lockedFile) int { return strings.Compare(a.Path, b.Path) })
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(lock); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (e *lockFileEffect) write() (*framework.FileWriteIO, error) {
+	content, err := e.content()
+	if err != nil {
+		return nil, err
+	}
+	return framework.NewDefaultFileWriteIO(e.path, &content), nil
+}
+
+func (e *lockFileEffect) Apply() error {
+	fw, err := e.write()
+	if err != nil {
+		return err
+	}
+	return fw.Apply()
+}
+
+func (e *lockFileEffect) ApplyTx(ctx context.Context) (framework.Tx, error) {
+	fw, err := e.write()
+	if err != nil {
+		return nil, err
+	}
+	return fw.ApplyTx(ctx)
+}
+
+func (e *lockFileEffect) Plan() []framework.Action {
+	return []framework.Action{{
+		Kind:   framework.ActionWrite,
+		Path:   e.path,
+		Detail: fmt.Sprintf("(lock file, %d generated file(s))", len(e.outputs)+len(e.kept)),
+	}}
+}
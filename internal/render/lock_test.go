@@ -0,0 +1,194 @@
+package render
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/niule-eu/hlcli/pkg/framework"
+)
+
+func TestLockEffects(t *testing.T) {
+	dir := t.TempDir()
+	module := filepath.Join(dir, "module.pkl")
+	a, b, c := filepath.Join(dir, "a.yaml"), filepath.Join(dir, "b.yaml"), filepath.Join(dir, "c.yaml")
+
+	render := func(t *testing.T, prune bool, outputs ...string) {
+		t.Helper()
+		var effects []framework.Effect
+		for _, o := range outputs {
+			content := []byte("generated: " + filepath.Base(o) + "\n")
+			effects = append(effects, framework.NewDefaultFileWriteIO(o, &content))
+		}
+		effects, err := lockEffects(RenderPklParams{PklFile: module, Prune: prune}, effects)
+		if err != nil {
+			t.Fatalf("lockEffects() failed: %v", err)
+		}
+		if err := framework.Invoke(context.Background(), effects...); err != nil {
+			t.Fatalf("Invoke() failed: %v", err)
+		}
+	}
+	locked := func(t *testing.T) []string {
+		t.Helper()
+		content, err := os.ReadFile(LockFilePath(module))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var lock renderLock
+		if err := json.Unmarshal(content, &lock); err != nil {
+			t.Fatal(err)
+		}
+		var paths []string
+		for _, f := range lock.Files {
+			paths = append(paths, f.Path)
+		}
+		return paths
+	}
+	exists := func(path string) bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+
+	render(t, false, a, b, c)
+	if got := locked(t); len(got) != 3 || got[0] != "a.yaml" || got[2] != "c.yaml" {
+		t.Fatalf("Expected a.yaml, b.yaml and c.yaml locked, got %v", got)
+	}
+
+	t.Run("keeps stale files without prune", func(t *testing.T) {
+		render(t, false, a, b)
+		if !exists(c) {
+			t.Error("Expected c.yaml to remain")
+		}
+		if got := locked(t); len(got) != 3 {
+			t.Errorf("Expected c.yaml to remain locked, got %v", got)
+		}
+	})
+
+	t.Run("prunes stale files it generated", func(t *testing.T) {
+		if err := os.WriteFile(b, []byte("edited by hand\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		render(t, true, a)
+		if exists(c) {
+			t.Error("Expected c.yaml to be pruned")
+		}
+		if !exists(b) {
+			t.Error("Expected modified b.yaml not to be pruned")
+		}
+		if got := locked(t); len(got) != 1 || got[0] != "a.yaml" {
+			t.Errorf("Expected only a.yaml locked, got %v", got)
+		}
+	})
+
+	t.Run("never deletes files it did not create", func(t *testing.T) {
+		other := filepath.Join(dir, "other.yaml")
+		if err := os.WriteFile(other, []byte("mine\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		render(t, true, a)
+		if !exists(other) {
+			t.Error("Expected other.yaml to remain")
+		}
+	})
+}
+
+func TestLockEffectsOutsideOfOutputRoot(t *testing.T) {
+	dir := t.TempDir()
+	module := filepath.Join(dir, "module", "module.pkl")
+	if err := os.Mkdir(filepath.Dir(module), 0755); err != nil {
+		t.Fatal(err)
+	}
+	outside := filepath.Join(dir, "outside.yaml")
+	if err := os.WriteFile(outside, []byte("not generated\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := fileHash(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"../outside.yaml", outside} {
+		t.Run("refuses to prune "+path, func(t *testing.T) {
+			lock, err := json.Marshal(renderLock{Module: "module.pkl", Files: []lockedFile{{Path: path, SHA256: hash}}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(LockFilePath(module), lock, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = lockEffects(RenderPklParams{PklFile: module, Prune: true}, nil)
+			var outputPathErr *OutputPathError
+			if !errors.As(err, &outputPathErr) {
+				t.Fatalf("Expected an OutputPathError, got %v", err)
+			}
+			if _, err := os.Stat(outside); err != nil {
+				t.Errorf("Expected %s to remain: %v", outside, err)
+			}
+		})
+	}
+}
+
+// Watching applies the changed effects only, see renderOnce.
+func TestLockEffectsChanged(t *testing.T) {
+	dir := t.TempDir()
+	module := filepath.Join(dir, "module.pkl")
+	a, b := filepath.Join(dir, "a.yaml"), filepath.Join(dir, "b.yaml")
+
+	render := func(t *testing.T, contentOfB string) []framework.Effect {
+		t.Helper()
+		contentOfA := []byte("a\n")
+		content := []byte(contentOfB)
+		effects, err := lockEffects(RenderPklParams{PklFile: module}, []framework.Effect{
+			framework.NewDefaultFileWriteIO(a, &contentOfA),
+			framework.NewDefaultFileWriteIO(b, &content),
+		})
+		if err != nil {
+			t.Fatalf("lockEffects() failed: %v", err)
+		}
+		changed, err := framework.Changed(effects...)
+		if err != nil {
+			t.Fatalf("Changed() failed: %v", err)
+		}
+		if err := framework.Invoke(context.Background(), changed...); err != nil {
+			t.Fatalf("Invoke() failed: %v", err)
+		}
+		return changed
+	}
+	lockedHash := func(t *testing.T, path string) string {
+		t.Helper()
+		lock, err := readRenderLock(LockFilePath(module))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range lock.Files {
+			if f.Path == path {
+				return f.SHA256
+			}
+		}
+		return ""
+	}
+
+	render(t, "b\n")
+	t.Run("writes the lock file after the changed outputs", func(t *testing.T) {
+		if changed := render(t, "b changed\n"); len(changed) != 2 {
+			t.Errorf("Expected b.yaml and the lock file to be written, got %d effects", len(changed))
+		}
+		hash, err := fileHash(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lockedHash(t, "b.yaml") != hash || lockedHash(t, "a.yaml") == "" {
+			t.Error("Expected the lock file to record both outputs as on disk")
+		}
+	})
+
+	t.Run("leaves the lock file when nothing changed", func(t *testing.T) {
+		if changed := render(t, "b changed\n"); len(changed) != 0 {
+			t.Errorf("Expected nothing to be written, got %d effects", len(changed))
+		}
+	})
+}
@@ -0,0 +1,245 @@
+package render
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/apple/pkl-go/pkl"
+	"github.com/knadh/koanf/v2"
+	"github.com/niule-eu/hlcli/pkg/framework"
+	"go.yaml.in/yaml/v3"
+)
+
+// RenderTarget is a module to render, as listed in a render manifest. Paths
+// are relative to the manifest, the module may also be a URI, see
+// ResolveModule.
+type RenderTarget struct {
+	Module      string `yaml:"module" json:"module"`
+	Expression  string `yaml:"expression,omitempty" json:"expression,omitempty"`
+	Output      string `yaml:"output,omitempty" json:"output,omitempty"` // Output file, /dev/stdout if empty
+	Files       bool   `yaml:"files,omitempty" json:"files,omitempty"`   // Write output.files instead of output.text
+	Sops        bool   `yaml:"sops,omitempty" json:"sops,omitempty"`     // Encrypt the output with SOPS
+	Prune       bool   `yaml:"prune,omitempty" json:"prune,omitempty"`   // Delete files the module no longer produces
+	OutputDir   string `yaml:"outputDir,omitempty" json:"outputDir,omitempty"`
+	ProjectFile string `yaml:"projectFile,omitempty" json:"projectFile,omitempty"`
+}
+
+// RenderManifest lists the modules rendered together by render-all. It is
+// read from YAML, or from a Pkl module amending hlcli:/render.pkl.
+type RenderManifest struct {
+	Targets []RenderTarget `yaml:"targets" json:"targets"`
+}
+
+// Params returns the parameters rendering t, resolving its paths against
+// the directory of the manifest.
+func (t RenderTarget) Params(manifestDir string) (RenderPklParams, error) {
+	if t.Module == "" {
+		return RenderPklParams{}, errors.New("target without module")
+	}
+	resolve := func(p string) string {
+		if p == "" || filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(manifestDir, p)
+	}
+	output := resolve(t.Output)
+	if output == "" {
+		output = "/dev/stdout"
+	}
+	pklFile, moduleUri, err := ResolveModule(t.Module, manifestDir)
+	if err != nil {
+		return RenderPklParams{}, err
+	}
+	outputDir := resolve(t.OutputDir)
+	if moduleUri != "" {
+		if t.Prune {
+			return RenderPklParams{}, &LocalModuleRequiredError{Module: moduleUri, Feature: "Pruning"}
+		}
+		// There is no module directory to write next to
+		if outputDir == "" {
+			outputDir = manifestDir
+		}
+	}
+	return RenderPklParams{
+		PklFile:            pklFile,
+		ModuleUri:          moduleUri,
+		Expression:         t.Expression,
+		OutputFile:         output,
+		MultipleFileOutput: t.Files,
+		PklProjectFile:     resolve(t.ProjectFile),
+		EncryptWithSops:    t.Sops,
+		OutputDir:          outputDir,
+		LockFile:           t.Files && moduleUri == "",
+		Prune:              t.Prune,
+	}, nil
+}
+
+// EvaluatorPool shares a single Pkl process between the renders of many
+// modules, with one evaluator per PklProject. It is safe for concurrent use.
+type EvaluatorPool struct {
+	secrets    *koanf.Koanf
+	settings   EvaluatorSettings
+	manager    pkl.EvaluatorManager
+	mu         sync.Mutex
+	evaluators map[string]pkl.Evaluator // By project root, "" outside of any project
+}
+
+// NewEvaluatorPool creates a pool whose evaluators read secrets, with the
+// settings shared by every module rendered.
+func NewEvaluatorPool(secrets *koanf.Koanf, settings EvaluatorSettings) *EvaluatorPool {
+	return &EvaluatorPool{
+		secrets:    secrets,
+		settings:   settings,
+		manager:    pkl.NewEvaluatorManager(),
+		evaluators: map[string]pkl.Evaluator{},
+	}
+}
+
+// Evaluator returns the evaluator for the module at pklFile, creating it on
+// first use.
+func (p *EvaluatorPool) Evaluator(ctx context.Context, pklFile string, pklProjectFile string) (pkl.Evaluator, error) {
+	projectRoot, err := findPklProjectRoot(pklFile, pklProjectFile)
+	if _, ok := err.(*PklProjectNotFoundError); ok {
+		projectRoot = ""
+	} else if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if evaluator, ok := p.evaluators[projectRoot]; ok {
+		return evaluator, nil
+	}
+	evaluator, err := newEvaluator(ctx, p.manager, projectRoot, p.secrets, p.settings, nil)
+	if err != nil {
+		return nil, err
+	}
+	p.evaluators[projectRoot] = evaluator
+	return evaluator, nil
+}
+
+// Close stops the Pkl process and every evaluator.
+func (p *EvaluatorPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, evaluator := range p.evaluators {
+		evaluator.Close()
+	}
+	return p.manager.Close()
+}
+
+// LoadRenderManifest reads the manifest at path. Manifests ending in .pkl
+// are evaluated with pool, others are parsed as YAML.
+func LoadRenderManifest(ctx context.Context, path string, pool *EvaluatorPool) (*RenderManifest, error) {
+	var manifest RenderManifest
+	if filepath.Ext(path) == ".pkl" {
+		evaluator, err := pool.Evaluator(ctx, path, "")
+		if err != nil {
+			return nil, err
+		}
+		var rendered string
+		err = evaluator.EvaluateExpression(ctx, pkl.FileSource(path), "new JsonRenderer {}.renderDocument(module)", &rendered)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(rendered), &manifest); err != nil {
+			return nil, fmt.Errorf("reading manifest %s: %w", path, err)
+		}
+		return &manifest, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(content, &manifest); err != nil {
+		return nil, fmt.Errorf("reading manifest %s: %w", path, err)
+	}
+	return &manifest, nil
+}
+
+// TargetResult is the outcome of rendering one target of a manifest.
+type TargetResult struct {
+	Target  RenderTarget
+	Effects []framework.Effect
+	Err     error
+}
+
+type RenderManifestParams struct {
+	ManifestDir        string   // Directory the paths of targets are relative to
+	Workers            int      // Maximum number of concurrent evaluations
+	AllowedOutputPaths []string // See RenderPklParams
+}
+
+func NewDefaultRenderManifestParams(manifestPath string) *RenderManifestParams {
+	return &RenderManifestParams{
+		ManifestDir:        filepath.Dir(manifestPath),
+		Workers:            1,
+		AllowedOutputPaths: []string{},
+	}
+}
+
+// RenderManifestTargets renders every target of manifest with at most
+// Workers evaluations running concurrently. Results are in manifest order.
+func RenderManifestTargets(
+	ctx context.Context,
+	manifest *RenderManifest,
+	pool *EvaluatorPool,
+	params *RenderManifestParams,
+) []TargetResult {
+	results := make([]TargetResult, len(manifest.Targets))
+	sem := make(chan struct{}, max(params.Workers, 1))
+	var wg sync.WaitGroup
+	for i, target := range manifest.Targets {
+		results[i].Target = target
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results[i].Effects, results[i].Err = renderTarget(ctx, target, pool, params)
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+func renderTarget(ctx context.Context, target RenderTarget, pool *EvaluatorPool, manifestParams *RenderManifestParams) ([]framework.Effect, error) {
+	params, err := target.Params(manifestParams.ManifestDir)
+	if err != nil {
+		return nil, err
+	}
+	params.AllowedOutputPaths = manifestParams.AllowedOutputPaths
+	params.EvaluatorSettings = pool.settings
+	evaluator, err := pool.Evaluator(ctx, params.PklFile, params.PklProjectFile)
+	if err != nil {
+		return nil, err
+	}
+	return renderModule(ctx, evaluator, params)
+}
+
+// WriteRenderSummary writes the number of files written by every target of
+// a manifest to w.
+func WriteRenderSummary(w io.Writer, results []TargetResult) error {
+	total := 0
+	for _, r := range results {
+		writes := 0
+		for _, a := range framework.Plan(r.Effects...) {
+			if a.Kind == framework.ActionWrite {
+				writes++
+			}
+		}
+		total += writes
+		if _, err := fmt.Fprintf(w, "%s: %d file(s)\n", r.Target.Module, writes); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "%d target(s), %d file(s)\n", len(results), total)
+	return err
+}
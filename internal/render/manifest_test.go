@@ -0,0 +1,112 @@
+package render
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/niule-eu/hlcli/pkg/framework"
+)
+
+func TestLoadRenderManifest(t *testing.T) {
+	dir := t.TempDir()
+	manifestPath := filepath.Join(dir, "render.yaml")
+	manifest := []byte(`targets:
+  - module: app/config.pkl
+    output: out/config.yaml
+    sops: true
+  - module: /abs/files.pkl
+    files: true
+    projectFile: app
+`)
+	if err := os.WriteFile(manifestPath, manifest, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadRenderManifest(context.Background(), manifestPath, nil)
+	if err != nil {
+		t.Fatalf("LoadRenderManifest() failed: %v", err)
+	}
+	if len(loaded.Targets) != 2 {
+		t.Fatalf("Expected 2 targets, got %d", len(loaded.Targets))
+	}
+
+	t.Run("resolves paths against the manifest", func(t *testing.T) {
+		params, err := loaded.Targets[0].Params(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := RenderPklParams{
+			PklFile:         filepath.Join(dir, "app/config.pkl"),
+			OutputFile:      filepath.Join(dir, "out/config.yaml"),
+			EncryptWithSops: true,
+		}
+		if params.PklFile != expected.PklFile || params.OutputFile != expected.OutputFile || !params.EncryptWithSops {
+			t.Errorf("Expected %+v, got %+v", expected, params)
+		}
+	})
+
+	t.Run("defaults output to stdout", func(t *testing.T) {
+		params, err := loaded.Targets[1].Params(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if params.PklFile != "/abs/files.pkl" || params.OutputFile != "/dev/stdout" || !params.MultipleFileOutput {
+			t.Errorf("Unexpected params %+v", params)
+		}
+		if params.PklProjectFile != filepath.Join(dir, "app") {
+			t.Errorf("Expected project file resolved against the manifest, got %s", params.PklProjectFile)
+		}
+	})
+
+	t.Run("keeps module URIs", func(t *testing.T) {
+		target := RenderTarget{Module: "package://example.com/infra@1.2.0#/main.pkl", Files: true}
+		params, err := target.Params(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if params.ModuleUri != target.Module || params.PklFile != "" || params.LockFile || params.OutputDir != dir {
+			t.Errorf("Unexpected params %+v", params)
+		}
+		target.Prune = true
+		var localErr *LocalModuleRequiredError
+		if _, err := target.Params(dir); !errors.As(err, &localErr) {
+			t.Errorf("Expected LocalModuleRequiredError, got %v", err)
+		}
+	})
+
+	t.Run("rejects targets without module", func(t *testing.T) {
+		if _, err := (RenderTarget{Output: "out.yaml"}).Params(dir); err == nil {
+			t.Error("Expected error, got nil")
+		}
+	})
+}
+
+func TestWriteRenderSummary(t *testing.T) {
+	a, b := []byte("a"), []byte("b")
+	results := []TargetResult{
+		{
+			Target: RenderTarget{Module: "a.pkl"},
+			Effects: []framework.Effect{
+				framework.NewDefaultFileWriteIO("a.yaml", &a),
+				framework.CompoundEffect{Effects: []framework.Effect{
+					framework.NewSopsEncryptEffect(&b, "", "b.yaml", nil),
+					framework.NewDefaultFileWriteIO("b.yaml", &b),
+				}},
+			},
+		},
+		{Target: RenderTarget{Module: "empty.pkl"}},
+	}
+
+	var out bytes.Buffer
+	if err := WriteRenderSummary(&out, results); err != nil {
+		t.Fatal(err)
+	}
+	expected := "a.pkl: 2 file(s)\nempty.pkl: 0 file(s)\n2 target(s), 2 file(s)\n"
+	if out.String() != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, out.String())
+	}
+}
@@ -0,0 +1,71 @@
+package render
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+
+	"github.com/apple/pkl-go/pkl"
+)
+
+// StdinModule is the module argument reading the module text from stdin.
+const StdinModule = "-"
+
+// ResolveModule tells local modules from the others. A module is either a
+// path, returned absolute, relative paths being relative to dir or to the
+// working directory if dir is empty, or a URI such as
+// package://example.com/infra@1.2.0#/main.pkl or modulepath:/main.pkl,
+// returned as is. file: URIs are returned as paths.
+func ResolveModule(module string, dir string) (path string, uri string, err error) {
+	// Single letter schemes are Windows drive letters
+	if u, err := url.Parse(module); err == nil && len(u.Scheme) > 1 {
+		if u.Scheme != "file" {
+			return "", module, nil
+		}
+		module = u.Path
+	}
+	if dir != "" && !filepath.IsAbs(module) {
+		module = filepath.Join(dir, module)
+	}
+	path, err = filepath.Abs(module)
+	return path, "", err
+}
+
+// moduleSource returns the source of the module of p: ModuleText, ModuleUri
+// or PklFile, in that order.
+func (p RenderPklParams) moduleSource() (*pkl.ModuleSource, error) {
+	switch {
+	case p.ModuleText != "":
+		return pkl.TextSource(p.ModuleText), nil
+	case p.ModuleUri != "":
+		if _, err := url.Parse(p.ModuleUri); err != nil {
+			return nil, fmt.Errorf("invalid module URI: %w", err)
+		}
+		return pkl.UriSource(p.ModuleUri), nil
+	default:
+		return pkl.FileSource(p.PklFile), nil
+	}
+}
+
+// moduleName returns the module of p as shown in messages.
+func (p RenderPklParams) moduleName() string {
+	switch {
+	case p.ModuleText != "":
+		return "<stdin>"
+	case p.ModuleUri != "":
+		return p.ModuleUri
+	default:
+		return p.PklFile
+	}
+}
+
+// LocalModuleRequiredError is returned when a feature needing the module on
+// disk, such as lock files, is used with a module read from stdin or a URI.
+type LocalModuleRequiredError struct {
+	Module  string
+	Feature string
+}
+
+func (e *LocalModuleRequiredError) Error() string {
+	return fmt.Sprintf("%s requires a local module, not '%s'", e.Feature, e.Module)
+}
@@ -0,0 +1,67 @@
+package render
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveModule(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		module string
+		dir    string
+		path   string
+		uri    string
+	}{
+		{module: "app.pkl", path: filepath.Join(wd, "app.pkl")},
+		{module: "app.pkl", dir: "/srv/manifests", path: "/srv/manifests/app.pkl"},
+		{module: "/srv/app.pkl", dir: "/srv/manifests", path: "/srv/app.pkl"},
+		{module: "file:///srv/app.pkl", path: "/srv/app.pkl"},
+		{module: "package://example.com/infra@1.2.0#/main.pkl", dir: "/srv", uri: "package://example.com/infra@1.2.0#/main.pkl"},
+		{module: "modulepath:/infra/main.pkl", uri: "modulepath:/infra/main.pkl"},
+	} {
+		path, uri, err := ResolveModule(tc.module, tc.dir)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.module, err)
+		}
+		if path != tc.path || uri != tc.uri {
+			t.Errorf("%s: expected path '%s' and URI '%s', got '%s' and '%s'", tc.module, tc.path, tc.uri, path, uri)
+		}
+	}
+}
+
+func TestModuleSource(t *testing.T) {
+	for _, tc := range []struct {
+		params RenderPklParams
+		uri    string
+		name   string
+	}{
+		{params: RenderPklParams{PklFile: "/srv/app.pkl"}, uri: "file:///srv/app.pkl", name: "/srv/app.pkl"},
+		{params: RenderPklParams{ModuleUri: "modulepath:/main.pkl"}, uri: "modulepath:/main.pkl", name: "modulepath:/main.pkl"},
+		{params: RenderPklParams{ModuleText: "foo = 1", PklFile: "/srv/app.pkl"}, uri: "repl:text", name: "<stdin>"},
+	} {
+		source, err := tc.params.moduleSource()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if source.Uri.String() != tc.uri || tc.params.moduleName() != tc.name {
+			t.Errorf("expected %s named %s, got %s named %s", tc.uri, tc.name, source.Uri, tc.params.moduleName())
+		}
+	}
+
+	if _, err := (RenderPklParams{ModuleUri: "package://%zz"}).moduleSource(); err == nil {
+		t.Error("expected an error for an invalid URI")
+	}
+
+	params := RenderPklParams{ModuleText: "foo = 1", MultipleFileOutput: true, LockFile: true}
+	var localErr *LocalModuleRequiredError
+	if _, err := renderModule(context.Background(), blockingEvaluator{}, params); !errors.As(err, &localErr) {
+		t.Errorf("expected LocalModuleRequiredError for a lock file of stdin, got %v", err)
+	}
+}
@@ -1,25 +1,25 @@
 package render
 
 import (
-	"archive/tar"
-	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"io"
 	"io/fs"
 	"log"
+	"maps"
 	"net/url"
 
 	// "log"
 
 	"path/filepath"
+	"slices"
 	"strings"
+	"time"
 
 	// "fmt"
 	"os"
 
 	"github.com/apple/pkl-go/pkl"
-	"github.com/getsops/sops/v3/decrypt"
 	"github.com/knadh/koanf/parsers/yaml"
 	"github.com/knadh/koanf/v2"
 	"github.com/niule-eu/hlcli/pkg/framework"
@@ -50,7 +50,24 @@ func (e *MultiplePklProjectFoundError) Error() string {
 	)
 }
 
-type SopsBlobResourceReader struct{}
+// OutputPathError is returned when a module writes a file outside of its
+// output root that is not explicitly allowed.
+type OutputPathError struct {
+	Key  string // Key of output.files
+	Path string
+	Root string
+}
+
+func (e *OutputPathError) Error() string {
+	return fmt.Sprintf(
+		"output file '%s' resolves to %s, outside of the output directory %s and of the allowed output paths",
+		e.Key, e.Path, e.Root,
+	)
+}
+
+type SopsBlobResourceReader struct {
+	sopsFiles
+}
 
 func (r SopsBlobResourceReader) Scheme() string { return "sopsblob" }
 
@@ -62,8 +79,7 @@ func (r SopsBlobResourceReader) ListElements(url url.URL) ([]pkl.PathElement, er
 
 func (r SopsBlobResourceReader) Read(url url.URL) ([]byte, error) {
 
-	p := url.Path
-	secretsBytes, err := decrypt.File(p, "binary")
+	secretsBytes, err := r.decrypt(url.Path)
 	if err != nil {
 		return nil, err
 	}
@@ -71,123 +87,266 @@ func (r SopsBlobResourceReader) Read(url url.URL) ([]byte, error) {
 	return secretsBytes, nil
 }
 
+// SopsResourceReader reads secrets by key path, from the secrets of the root
+// command as sops:/<key path>, or from a named secret store as
+// sops://<store>/<key path>.
 type SopsResourceReader struct {
 	secrets *koanf.Koanf
+	stores  *secretStores
+	reads   *resourceReads
 }
 
 func (r SopsResourceReader) Scheme() string { return "sops" }
 
-func (r SopsResourceReader) IsGlobbable() bool { return false }
+func (r SopsResourceReader) IsGlobbable() bool { return true }
 
-func (r SopsResourceReader) HasHierarchicalUris() bool { return false }
+func (r SopsResourceReader) HasHierarchicalUris() bool { return true }
 
-func (r SopsResourceReader) ListElements(url url.URL) ([]pkl.PathElement, error) { return nil, nil }
+// tree returns the secrets addressed by url.
+func (r SopsResourceReader) tree(url url.URL) (*koanf.Koanf, error) {
+	if url.Host != "" {
+		return r.stores.store(url.Host)
+	}
+	r.reads.addSecrets()
+	return r.secrets, nil
+}
+
+// ListElements lists the keys directly under the key path of url, keys
+// holding a subtree as directories.
+func (r SopsResourceReader) ListElements(url url.URL) ([]pkl.PathElement, error) {
+	secrets, err := r.tree(url)
+	if err != nil {
+		return nil, err
+	}
+	tree := secrets.Raw()
+	if key := secretsKey(url); key != "" {
+		tree = secrets.Cut(key).Raw()
+	}
+	elements := make([]pkl.PathElement, 0, len(tree))
+	for name, v := range tree {
+		_, isDir := v.(map[string]any)
+		elements = append(elements, pkl.NewPathElement(name, isDir))
+	}
+	return sortedElements(elements), nil
+}
 
 func (r SopsResourceReader) Read(url url.URL) ([]byte, error) {
 
-	key := strings.Replace(url.Path[1:], "/", ".", -1)
-	subMap := r.secrets.Cut(key)
+	secrets, err := r.tree(url)
+	if err != nil {
+		return nil, err
+	}
+	key := secretsKey(url)
+	if key == "" {
+		return secrets.Marshal(parser)
+	}
+	subMap := secrets.Cut(key)
 
 	if len(subMap.Keys()) > 0 {
 		return subMap.Marshal(parser)
 	} else {
-		return []byte(r.secrets.String(key)), nil
+		return []byte(secrets.String(key)), nil
 	}
 }
 
-type SopsTarResourceReader struct{}
-
-func (r SopsTarResourceReader) Scheme() string { return "sopstar" }
-
-func (r SopsTarResourceReader) IsGlobbable() bool { return false }
-
-func (r SopsTarResourceReader) HasHierarchicalUris() bool { return true }
-
-func (r SopsTarResourceReader) ListElements(url url.URL) ([]pkl.PathElement, error) { return nil, nil }
+// secretsKey returns the koanf key addressed by the path of a sops: URI.
+func secretsKey(url url.URL) string {
+	return strings.ReplaceAll(strings.Trim(url.Path, "/"), "/", ".")
+}
 
-func (r SopsTarResourceReader) Read(url url.URL) ([]byte, error) {
+// EvaluatorSettings restrict what evaluated modules may import and read.
+// Unset fields keep the settings of the PklProject, or the defaults of Pkl.
+type EvaluatorSettings struct {
+	AllowedModules   []string          // URI patterns of the modules that may be imported, hlcli: is always allowed
+	AllowedResources []string          // URI patterns of the resources that may be read, replacing the sops resources of hlcli too
+	RootDir          string            // Directory local modules and resources must be within
+	Env              map[string]string // Environment read through env:, the environment of hlcli if nil
+	Properties       map[string]string // External properties read through prop:
+	ModuleCacheDir   string            // Cache of package: modules, ~/.pkl/cache if empty
+	ModulePath       []string          // Directories, ZIP and JAR archives searched for modulepath: modules
+	Timeout          time.Duration     // Limit of a single render, none if zero
+	SecretStores     map[string]string // SOPS file of each secret store read as sops://<name>/, by name
+}
 
-	p := url.Path
-	fragment := url.Fragment
+// EvaluationTimeoutError is returned when rendering a module takes longer
+// than EvaluatorSettings.Timeout.
+type EvaluationTimeoutError struct {
+	Module  string
+	Timeout time.Duration
+}
 
-	secretsBytes, err := decrypt.File(p, "binary")
-	if err != nil {
-		return nil, err
-	}
-	buf := bytes.NewBuffer(secretsBytes)
-	tr := tar.NewReader(buf)
-	fileBytes := &bytes.Buffer{}
-	for {
-		hdr, err := tr.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return nil, err
-		}
-		if hdr.Name == fragment {
-			_, err := io.Copy(fileBytes, tr)
-			if err != nil {
-				return nil, err
-			}
-			return fileBytes.Bytes(), nil
-		}
-	}
-	return secretsBytes, nil
+func (e *EvaluationTimeoutError) Error() string {
+	return fmt.Sprintf("Rendering module '%s' timed out after %s", e.Module, e.Timeout)
 }
 
+func (e *EvaluationTimeoutError) Unwrap() error { return context.DeadlineExceeded }
+
 type RenderPklParams struct {
+	EvaluatorSettings
 	PklFile            string
+	ModuleUri          string // Module to render instead of PklFile, e.g. package:// or modulepath: URIs
+	ModuleText         string // Text of the module to render instead of PklFile, e.g. read from stdin
 	OutputFile         string
 	Expression         string
+	Formats            []string // Render output.value, or the value of Expression, in each of OutputFormats instead
 	MultipleFileOutput bool
-	AllowedModules     []string
 	PklProjectFile     string
 	EncryptWithSops    bool
 	EnvVars            map[string]string
+	OutputDir          string   // Root of multi-file output, the module directory if empty
+	AllowedOutputPaths []string // Files or directories outside of OutputDir that output may be written to
+	LockFile           bool     // Record multi-file output in a lock file next to the module, which must be PklFile
+	Prune              bool     // Delete files of the lock file no longer produced, requires LockFile
 }
 
-func RenderPkl(params RenderPklParams, secrets *koanf.Koanf) ([]framework.Effect, error) {
-	var err error
-	var evaluator_err error
-	var evaluator pkl.Evaluator
-
-	evaluatorManager := pkl.NewEvaluatorManager()
+// Renderer evaluates a Pkl module into effects. The Pkl evaluator is kept
+// between renders, Refresh replaces it once files it has read change, since
+// Pkl caches modules and resources for the lifetime of an evaluator.
+type Renderer struct {
+	params      RenderPklParams
+	secrets     *koanf.Koanf
+	manager     pkl.EvaluatorManager
+	evaluator   pkl.Evaluator
+	projectRoot string // Directory of the PklProject, empty if there is none
+	reads       *resourceReads
+}
 
-	pkl_project_root, err := findPklProjectRoot(params.PklFile, params.PklProjectFile)
+func NewRenderer(ctx context.Context, params RenderPklParams, secrets *koanf.Koanf) (*Renderer, error) {
+	projectRoot, err := findPklProjectRoot(params.PklFile, params.PklProjectFile)
 	if _, ok := err.(*PklProjectNotFoundError); ok {
-		evaluator, evaluator_err = evaluatorManager.NewEvaluator(
-			context.Background(),
+		projectRoot = ""
+	} else if err != nil {
+		return nil, err
+	}
+
+	r := &Renderer{
+		params:      params,
+		secrets:     secrets,
+		manager:     pkl.NewEvaluatorManager(),
+		projectRoot: projectRoot,
+		reads:       &resourceReads{},
+	}
+	if r.evaluator, err = r.newEvaluator(ctx); err != nil {
+		r.manager.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Renderer) newEvaluator(ctx context.Context) (pkl.Evaluator, error) {
+	return newEvaluator(ctx, r.manager, r.projectRoot, r.secrets, r.params.EvaluatorSettings, r.reads)
+}
+
+// newEvaluator creates an evaluator for the modules of the PklProject at
+// projectRoot, or for modules outside of any project if it is empty. Its
+// resource readers share a decryption cache, cleared when it is closed.
+func newEvaluator(
+	ctx context.Context,
+	manager pkl.EvaluatorManager,
+	projectRoot string,
+	secrets *koanf.Koanf,
+	settings EvaluatorSettings,
+	reads *resourceReads,
+) (pkl.Evaluator, error) {
+	cache := newDecryptCache()
+	options := evaluatorOptions(secrets, settings, newSecretStores(settings.SecretStores, reads), sopsFiles{reads: reads, cache: cache})
+	var evaluator pkl.Evaluator
+	var err error
+	if projectRoot == "" {
+		evaluator, err = manager.NewEvaluator(
+			ctx,
 			pkl.PreconfiguredOptions,
-			evaluatorOptions(secrets),
+			options,
 		)
-		if evaluator_err != nil {
-			return nil, evaluator_err
-		}
-	} else if err == nil {
-		evaluator, evaluator_err = evaluatorManager.NewProjectEvaluator(
-			context.Background(),
+	} else {
+		evaluator, err = manager.NewProjectEvaluator(
+			ctx,
 			&url.URL{
 				Scheme: "file",
-				Path:   pkl_project_root,
+				Path:   projectRoot,
 			},
 			pkl.PreconfiguredOptions,
-			evaluatorOptions(secrets),
+			options,
 		)
-		if evaluator_err != nil {
-			return nil, evaluator_err
-		}
-	} else {
+	}
+	if err != nil {
 		return nil, err
 	}
-	defer evaluator.Close()
+	return &cachingEvaluator{Evaluator: evaluator, cache: cache}, nil
+}
 
+// Refresh replaces the evaluator, so that the next render sees the current
+// content of modules and resources. pkl-go keeps the modules and resources an
+// evaluator read for its lifetime and cannot invalidate them, so reusing it
+// would render stale content. The Pkl server is reused, and the old evaluator
+// is closed first, keeping a single evaluator alive. Renders fail after a
+// failed Refresh.
+func (r *Renderer) Refresh(ctx context.Context) error {
+	r.evaluator.Close()
+	r.reads.reset()
+	evaluator, err := r.newEvaluator(ctx)
+	if err != nil {
+		return err
+	}
+	r.evaluator = evaluator
+	return nil
+}
+
+// Close stops the Pkl evaluator.
+func (r *Renderer) Close() error {
+	r.evaluator.Close()
+	return r.manager.Close()
+}
+
+func RenderPkl(params RenderPklParams, secrets *koanf.Koanf) ([]framework.Effect, error) {
+	r, err := NewRenderer(context.Background(), params, secrets)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return r.Render(context.Background())
+}
+
+// Render evaluates the module and returns the effects writing its output.
+func (r *Renderer) Render(ctx context.Context) ([]framework.Effect, error) {
+	return renderModule(ctx, r.evaluator, r.params)
+}
+
+// renderModule evaluates the module of params with evaluator and returns the
+// effects writing its output, giving up after params.Timeout.
+func renderModule(ctx context.Context, evaluator pkl.Evaluator, params RenderPklParams) ([]framework.Effect, error) {
+	if params.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, params.Timeout)
+		defer cancel()
+	}
+	effects, err := evaluateModule(ctx, evaluator, params)
+	if errors.Is(err, context.DeadlineExceeded) && ctx.Err() != nil {
+		return nil, &EvaluationTimeoutError{Module: params.moduleName(), Timeout: params.Timeout}
+	}
+	return effects, err
+}
+
+func evaluateModule(ctx context.Context, evaluator pkl.Evaluator, params RenderPklParams) ([]framework.Effect, error) {
 	var effects []framework.Effect
 	// var files map[string][]byte
+	source, err := params.moduleSource()
+	if err != nil {
+		return nil, err
+	}
+	if params.LockFile && params.MultipleFileOutput && (params.ModuleText != "" || params.ModuleUri != "") {
+		return nil, &LocalModuleRequiredError{Module: params.moduleName(), Feature: "A lock file"}
+	}
 
 	// Check if expression provided, if yes evaluate expression and write to file
-	if params.Expression != "" {
-		data, err := evaluator.EvaluateExpressionRaw(context.Background(), pkl.FileSource(params.PklFile), params.Expression)
+	if len(params.Formats) > 0 {
+		effects, err = renderFormats(ctx, evaluator, source, params)
+		if err != nil {
+			return nil, err
+		}
+
+	} else if params.Expression != "" {
+		data, err := evaluator.EvaluateExpressionRaw(ctx, source, params.Expression)
 		if err != nil {
 			return nil, err
 		}
@@ -197,23 +356,35 @@ func RenderPkl(params RenderPklParams, secrets *koanf.Koanf) ([]framework.Effect
 		}
 
 	} else if params.MultipleFileOutput {
-		files, err := evaluator.EvaluateOutputFilesBytes(context.Background(), pkl.FileSource(params.PklFile))
+		files, err := evaluator.EvaluateOutputFilesBytes(ctx, source)
+		if err != nil {
+			return nil, err
+		}
+		rules, err := sopsFileRules(ctx, evaluator, source, params.moduleName(), files)
 		if err != nil {
 			return nil, err
 		}
 		for k, v := range files {
-			targPath := ""
-			if filepath.IsAbs(k) {
-				targPath = k
-			} else {
-				targPath = filepath.Join(filepath.Dir(params.PklFile), k)
+			targPath, err := outputPath(params, k)
+			if err != nil {
+				return nil, err
 			}
-			eff := []framework.Effect{framework.NewDefaultFileWriteIO(targPath, &v)}
-			effects = append(effects, eff...)
+			write := framework.NewDefaultFileWriteIO(targPath, &v)
+			rule, ok := rules[k]
+			if !ok {
+				effects = append(effects, write)
+				continue
+			}
+			// Encrypted as requested by the module, whatever EncryptWithSops
+			encrypt := framework.NewSopsEncryptEffect(&v, "", targPath, params.EnvVars)
+			encrypt.Rule = rule
+			effects = append(effects, framework.CompoundEffect{
+				Effects: []framework.Effect{encrypt, write},
+			})
 		}
 
 	} else {
-		data, err := evaluator.EvaluateExpressionRaw(context.Background(), pkl.FileSource(params.PklFile), "output.text")
+		data, err := evaluator.EvaluateExpressionRaw(ctx, source, "output.text")
 		if err != nil {
 			return nil, err
 		}
@@ -245,17 +416,119 @@ func RenderPkl(params RenderPklParams, secrets *koanf.Koanf) ([]framework.Effect
 		effects = encryptedEffects
 	}
 
+	if params.LockFile && params.MultipleFileOutput {
+		return lockEffects(params, effects)
+	}
 	return effects, nil
 }
 
-func evaluatorOptions(secrets *koanf.Koanf) func(*pkl.EvaluatorOptions) {
+func evaluatorOptions(secrets *koanf.Koanf, settings EvaluatorSettings, stores *secretStores, files sopsFiles) func(*pkl.EvaluatorOptions) {
 	return func(options *pkl.EvaluatorOptions) {
-		options.ResourceReaders = append(options.ResourceReaders, SopsResourceReader{secrets: secrets})
-		options.ResourceReaders = append(options.ResourceReaders, SopsBlobResourceReader{})
-		options.ResourceReaders = append(options.ResourceReaders, SopsTarResourceReader{})
-		options.AllowedResources = append(options.AllowedResources, "sops")
-		options.AllowedResources = append(options.AllowedResources, "sopsblob")
-		options.AllowedResources = append(options.AllowedResources, "sopstar")
+		settings.apply(options)
+		options.ResourceReaders = append(options.ResourceReaders, SopsResourceReader{secrets: secrets, stores: stores, reads: files.reads})
+		options.ResourceReaders = append(options.ResourceReaders, SopsBlobResourceReader{files})
+		options.ResourceReaders = append(options.ResourceReaders, SopsTarResourceReader{files})
+		options.ResourceReaders = append(options.ResourceReaders, SopsZipResourceReader{files})
+		pkl.WithModuleReader(HlcliModuleReader{})(options)
+		if settings.AllowedResources == nil {
+			options.AllowedResources = append(options.AllowedResources, "sops")
+			options.AllowedResources = append(options.AllowedResources, "sopsblob")
+			options.AllowedResources = append(options.AllowedResources, "sopstar")
+			options.AllowedResources = append(options.AllowedResources, "sopszip")
+		}
+	}
+}
+
+// apply overrides options with the settings that are set.
+func (s EvaluatorSettings) apply(options *pkl.EvaluatorOptions) {
+	if s.AllowedModules != nil {
+		options.AllowedModules = slices.Clone(s.AllowedModules)
+	}
+	if s.AllowedResources != nil {
+		options.AllowedResources = slices.Clone(s.AllowedResources)
+	}
+	if s.RootDir != "" {
+		options.RootDir = s.RootDir
+	}
+	if s.Env != nil {
+		options.Env = maps.Clone(s.Env)
+	}
+	if s.Properties != nil {
+		options.Properties = maps.Clone(s.Properties)
+	}
+	if s.ModuleCacheDir != "" {
+		options.CacheDir = s.ModuleCacheDir
+	}
+	if s.ModulePath != nil {
+		options.ModulePaths = slices.Clone(s.ModulePath)
+	}
+}
+
+// outputPath resolves the key of an output file against the output root of
+// params. Paths escaping the root, directly or through symlinks, are
+// rejected unless they are within AllowedOutputPaths.
+func outputPath(params RenderPklParams, key string) (string, error) {
+	root := params.OutputDir
+	if root == "" {
+		root = filepath.Dir(params.PklFile)
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Clean(key)
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(root, path)
+	}
+
+	resolvedRoot, err := resolveExisting(root)
+	if err != nil {
+		return "", err
+	}
+	resolvedPath, err := resolveExisting(path)
+	if err != nil {
+		return "", err
+	}
+	if isWithin(resolvedRoot, resolvedPath) {
+		return path, nil
+	}
+	for _, allowed := range params.AllowedOutputPaths {
+		allowed, err := filepath.Abs(allowed)
+		if err != nil {
+			return "", err
+		}
+		if resolvedAllowed, err := resolveExisting(allowed); err == nil && isWithin(resolvedAllowed, resolvedPath) {
+			return path, nil
+		}
+	}
+	return "", &OutputPathError{Key: key, Path: resolvedPath, Root: root}
+}
+
+// isWithin reports whether path is dir or inside of it. Both must be clean
+// and absolute.
+func isWithin(dir string, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// resolveExisting resolves the symlinks of the longest existing prefix of the
+// absolute path, keeping the rest as is.
+func resolveExisting(path string) (string, error) {
+	var rest []string
+	for {
+		resolved, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			return filepath.Join(append([]string{resolved}, rest...)...), nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return filepath.Join(append([]string{path}, rest...)...), nil
+		}
+		rest = append([]string{filepath.Base(path)}, rest...)
+		path = parent
 	}
 }
 
@@ -2,12 +2,17 @@ package render
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"slices"
 	"testing"
+	"time"
 
+	"github.com/apple/pkl-go/pkl"
 	"github.com/knadh/koanf/v2"
 	"github.com/niule-eu/hlcli/pkg/framework"
 	testutils "github.com/niule-eu/hlcli/test"
@@ -97,11 +102,6 @@ output {
 	})
 
 	t.Run("RenderPkl with SOPS encryption flag", func(t *testing.T) {
-		// Check if SOPS is available
-		if _, err := exec.LookPath("sops"); err != nil {
-			t.Skip("SOPS binary not available, skipping SOPS encryption test")
-		}
-
 		tmpFile := execEnv.GetYamlPath()
 
 		params := RenderPklParams{
@@ -172,11 +172,6 @@ output {
 	})
 
 	t.Run("RenderPkl with multiple file output and SOPS encryption", func(t *testing.T) {
-		// Check if SOPS is available
-		if _, err := exec.LookPath("sops"); err != nil {
-			t.Skip("SOPS binary not available, skipping SOPS encryption test")
-		}
-
 		params := RenderPklParams{
 			PklFile:            testPklFile,
 			MultipleFileOutput: true,
@@ -230,4 +225,281 @@ output {
 			}
 		}
 	})
+
+	t.Run("RenderPkl with per-file SOPS encryption from the module", func(t *testing.T) {
+		dir := t.TempDir()
+		pklFile := filepath.Join(dir, "files.pkl")
+		module := fmt.Sprintf(`
+import "hlcli:/sops.pkl"
+
+output {
+  files {
+    ["plain.yaml"] { value = new Dynamic { data = "visible" }; renderer = new YamlRenderer {} }
+    ["secret.yaml"] { value = new Dynamic { data = "hidden" }; renderer = new YamlRenderer {} }
+  }
+}
+
+sopsFiles: sops.Files = new {
+  ["secret.yaml"] { keyGroups { new { age { %q } } } }
+}
+`, execEnv.AgeRecipient)
+		if err := os.WriteFile(pklFile, []byte(module), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		effects, err := RenderPkl(RenderPklParams{
+			PklFile:            pklFile,
+			MultipleFileOutput: true,
+			EnvVars:            execEnv.EnvVars,
+		}, koanf.New("."))
+		if err != nil {
+			t.Fatalf("RenderPkl failed: %v", err)
+		}
+		for _, effect := range effects {
+			if err := effect.Apply(); err != nil {
+				t.Fatalf("Effect execution failed: %v", err)
+			}
+		}
+
+		plain, err := os.ReadFile(filepath.Join(dir, "plain.yaml"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(plain) != "data: visible\n" {
+			t.Errorf("Expected plain.yaml unencrypted, got: %s", plain)
+		}
+		secret, err := os.ReadFile(filepath.Join(dir, "secret.yaml"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(secret, []byte("hidden")) || !bytes.Contains(secret, []byte("sops:")) {
+			t.Errorf("Expected secret.yaml encrypted, got: %s", secret)
+		}
+	})
+}
+
+func TestOutputPath(t *testing.T) {
+	dir := t.TempDir()
+	moduleDir := filepath.Join(dir, "module")
+	allowedDir := filepath.Join(dir, "allowed")
+	for _, d := range []string{moduleDir, allowedDir} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(dir, filepath.Join(moduleDir, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	params := RenderPklParams{
+		PklFile:            filepath.Join(moduleDir, "module.pkl"),
+		AllowedOutputPaths: []string{allowedDir},
+	}
+
+	t.Run("resolves keys against the module directory", func(t *testing.T) {
+		for key, expected := range map[string]string{
+			"out/a.yaml":        filepath.Join(moduleDir, "out/a.yaml"),
+			"out/../b.yaml":     filepath.Join(moduleDir, "b.yaml"),
+			"../allowed/c.yaml": filepath.Join(allowedDir, "c.yaml"),
+			allowedDir + "/d":   filepath.Join(allowedDir, "d"),
+		} {
+			path, err := outputPath(params, key)
+			if err != nil {
+				t.Errorf("outputPath(%q) failed: %v", key, err)
+			} else if path != expected {
+				t.Errorf("outputPath(%q) = %s, expected %s", key, path, expected)
+			}
+		}
+	})
+
+	t.Run("rejects paths escaping the output directory", func(t *testing.T) {
+		for _, key := range []string{"../other.yaml", "/etc/passwd", "escape/other.yaml", "../allowed-not/x"} {
+			_, err := outputPath(params, key)
+			var pathErr *OutputPathError
+			if !errors.As(err, &pathErr) {
+				t.Errorf("Expected OutputPathError for %q, got %v", key, err)
+			}
+		}
+	})
+
+	t.Run("uses the output directory as root", func(t *testing.T) {
+		withOutputDir := params
+		withOutputDir.OutputDir = filepath.Join(dir, "out")
+		path, err := outputPath(withOutputDir, "a.yaml")
+		if err != nil || path != filepath.Join(dir, "out", "a.yaml") {
+			t.Errorf("Expected path in the output directory, got %s (%v)", path, err)
+		}
+		if _, err := outputPath(withOutputDir, "../module/a.yaml"); err == nil {
+			t.Error("Expected the module directory to be outside of the output directory")
+		}
+	})
+}
+
+func elementNames(elements []pkl.PathElement) []string {
+	var names []string
+	for _, e := range elements {
+		name := e.Name()
+		if e.IsDirectory() {
+			name += "/"
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+func TestSopsResourceReaderListElements(t *testing.T) {
+	secrets := koanf.New(".")
+	for key, value := range map[string]string{
+		"db.password":  "secret",
+		"db.users.app": "app-secret",
+		"api.token":    "token",
+		"standalone":   "value",
+	} {
+		secrets.Set(key, value)
+	}
+	reader := SopsResourceReader{secrets: secrets}
+
+	for path, expected := range map[string][]string{
+		"/":         {"api/", "db/", "standalone"},
+		"/db/":      {"password", "users/"},
+		"/db/users": {"app"},
+	} {
+		elements, err := reader.ListElements(url.URL{Scheme: "sops", Path: path})
+		if err != nil {
+			t.Fatalf("ListElements(%s) failed: %v", path, err)
+		}
+		if got := elementNames(elements); !slices.Equal(got, expected) {
+			t.Errorf("ListElements(%s) = %v, expected %v", path, got, expected)
+		}
+	}
+}
+
+func TestEvaluatorSettings(t *testing.T) {
+	defaults := func() *pkl.EvaluatorOptions {
+		options := &pkl.EvaluatorOptions{}
+		pkl.PreconfiguredOptions(options)
+		return options
+	}
+	files := sopsFiles{cache: newDecryptCache()}
+
+	t.Run("keeps the defaults when unset", func(t *testing.T) {
+		options := defaults()
+		evaluatorOptions(koanf.New("."), EvaluatorSettings{}, newSecretStores(nil, nil), files)(options)
+		for _, scheme := range []string{"sops", "sopsblob", "sopstar", "sopszip"} {
+			if !slices.Contains(options.AllowedResources, scheme) {
+				t.Errorf("%s: not an allowed resource in %v", scheme, options.AllowedResources)
+			}
+		}
+		if !slices.Contains(options.AllowedModules, "file:") || !slices.Contains(options.AllowedModules, "hlcli:") {
+			t.Errorf("missing default allowed modules in %v", options.AllowedModules)
+		}
+	})
+
+	t.Run("replaces the defaults when set", func(t *testing.T) {
+		settings := EvaluatorSettings{
+			AllowedModules:   []string{"file:"},
+			AllowedResources: []string{"prop:", "sops:"},
+			RootDir:          "/srv/modules",
+			Env:              map[string]string{"STAGE": "prod"},
+			Properties:       map[string]string{"region": "eu"},
+			ModuleCacheDir:   "/var/cache/pkl",
+			ModulePath:       []string{"/srv/pkl/infra.zip"},
+		}
+		options := defaults()
+		evaluatorOptions(koanf.New("."), settings, newSecretStores(nil, nil), files)(options)
+		if !slices.Equal(options.AllowedModules, []string{"file:", "hlcli:"}) {
+			t.Errorf("expected only file: and hlcli: modules, got %v", options.AllowedModules)
+		}
+		if !slices.Equal(options.AllowedResources, settings.AllowedResources) {
+			t.Errorf("expected resources %v, got %v", settings.AllowedResources, options.AllowedResources)
+		}
+		if options.RootDir != settings.RootDir || options.CacheDir != settings.ModuleCacheDir {
+			t.Errorf("expected root %s and cache %s, got %s and %s", settings.RootDir, settings.ModuleCacheDir, options.RootDir, options.CacheDir)
+		}
+		if len(options.Env) != 1 || options.Env["STAGE"] != "prod" {
+			t.Errorf("expected only the configured env, got %v", options.Env)
+		}
+		if !slices.Equal(options.ModulePaths, settings.ModulePath) {
+			t.Errorf("expected module path %v, got %v", settings.ModulePath, options.ModulePaths)
+		}
+		if options.Properties["region"] != "eu" {
+			t.Errorf("expected property region, got %v", options.Properties)
+		}
+	})
+}
+
+// blockingEvaluator evaluates nothing until its context is done.
+type blockingEvaluator struct {
+	pkl.Evaluator
+}
+
+func (e blockingEvaluator) EvaluateExpressionRaw(ctx context.Context, source *pkl.ModuleSource, expr string) ([]byte, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestRenderModuleTimeout(t *testing.T) {
+	params := RenderPklParams{
+		EvaluatorSettings: EvaluatorSettings{Timeout: 10 * time.Millisecond},
+		PklFile:           "/modules/slow.pkl",
+		Expression:        "output.text",
+		OutputFile:        "/dev/stdout",
+	}
+	_, err := renderModule(context.Background(), blockingEvaluator{}, params)
+	var timeoutErr *EvaluationTimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("expected EvaluationTimeoutError, got %v", err)
+	}
+	if timeoutErr.Module != params.PklFile || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = renderModule(ctx, blockingEvaluator{}, params)
+	if !errors.Is(err, context.Canceled) || errors.As(err, &timeoutErr) {
+		t.Errorf("expected cancellation to be reported as is, got %v", err)
+	}
+}
+
+// countingManager creates evaluators and counts the ones not closed yet.
+type countingManager struct {
+	pkl.EvaluatorManager
+	open    *int
+	maxOpen *int
+}
+
+func (m countingManager) NewEvaluator(ctx context.Context, opts ...func(options *pkl.EvaluatorOptions)) (pkl.Evaluator, error) {
+	*m.open++
+	*m.maxOpen = max(*m.maxOpen, *m.open)
+	return countedEvaluator{open: m.open}, nil
+}
+
+type countedEvaluator struct {
+	pkl.Evaluator
+	open *int
+}
+
+func (e countedEvaluator) Close() error {
+	*e.open--
+	return nil
+}
+
+func TestRendererRefresh(t *testing.T) {
+	var open, maxOpen int
+	r := &Renderer{
+		manager: countingManager{open: &open, maxOpen: &maxOpen},
+		reads:   &resourceReads{},
+	}
+	var err error
+	if r.evaluator, err = r.newEvaluator(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		if err := r.Refresh(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if open != 1 || maxOpen != 1 {
+		t.Errorf("Expected a single evaluator at a time, got %d open, at most %d", open, maxOpen)
+	}
 }
@@ -0,0 +1,62 @@
+package render
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/knadh/koanf/v2"
+	"github.com/niule-eu/hlcli/pkg/config"
+)
+
+// UnknownSecretStoreError is returned when a module reads from a secret store
+// that is not configured.
+type UnknownSecretStoreError struct {
+	Name string
+}
+
+func (e *UnknownSecretStoreError) Error() string {
+	return fmt.Sprintf("Unknown secret store '%s'", e.Name)
+}
+
+// secretStores are the named secret stores of an evaluator, read by modules
+// as sops://<name>/<key path>. Each is backed by its own SOPS-encrypted YAML
+// file, decrypted on first read. A nil *secretStores has no stores.
+type secretStores struct {
+	paths  map[string]string // SOPS file by store name
+	reads  *resourceReads
+	mu     sync.Mutex
+	loaded map[string]*koanf.Koanf
+}
+
+func newSecretStores(paths map[string]string, reads *resourceReads) *secretStores {
+	return &secretStores{paths: paths, reads: reads, loaded: map[string]*koanf.Koanf{}}
+}
+
+// store returns the secrets of the store name, decrypting its file on first
+// use.
+func (s *secretStores) store(name string) (*koanf.Koanf, error) {
+	if s == nil {
+		return nil, &UnknownSecretStoreError{Name: name}
+	}
+	p, ok := s.paths[name]
+	if !ok {
+		return nil, &UnknownSecretStoreError{Name: name}
+	}
+	s.reads.addFile(p)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if secrets, ok := s.loaded[name]; ok {
+		return secrets, nil
+	}
+	params := config.NewDefaultLoadSecretsParams()
+	secrets := koanf.NewWithConf(*params.Cfg)
+	err := config.LoadSecrets(params, secrets, func(lsp *config.LoadSecretsParams) {
+		lsp.SecretsPaths = append(lsp.SecretsPaths, p)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("loading secret store '%s': %w", name, err)
+	}
+	s.loaded[name] = secrets
+	return secrets, nil
+}
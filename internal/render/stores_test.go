@@ -0,0 +1,70 @@
+package render
+
+import (
+	"errors"
+	"net/url"
+	"slices"
+	"testing"
+
+	"github.com/knadh/koanf/v2"
+	testutils "github.com/niule-eu/hlcli/test"
+)
+
+func TestSopsResourceReaderSecretStores(t *testing.T) {
+	execEnv := testutils.NewSopsExecEnv(t)
+	for k, v := range execEnv.EnvVars {
+		t.Setenv(k, v)
+	}
+	stores := map[string]string{
+		"prod":    encryptedArchive(t, execEnv, "prod.yaml", []byte("db:\n  password: prod-password\n")),
+		"staging": encryptedArchive(t, execEnv, "staging.yaml", []byte("db:\n  password: staging-password\n")),
+	}
+	secrets := koanf.New(".")
+	secrets.Set("db.password", "default-password")
+	reads := &resourceReads{}
+	reader := SopsResourceReader{secrets: secrets, stores: newSecretStores(stores, reads), reads: reads}
+
+	t.Run("reads every store apart", func(t *testing.T) {
+		for uri, expected := range map[string]string{
+			"sops:/db/password":          "default-password",
+			"sops://prod/db/password":    "prod-password",
+			"sops://staging/db/password": "staging-password",
+		} {
+			u, err := url.Parse(uri)
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, err := reader.Read(*u)
+			if err != nil {
+				t.Fatalf("Read(%s) failed: %v", uri, err)
+			}
+			if string(content) != expected {
+				t.Errorf("Read(%s) = %q, expected %q", uri, content, expected)
+			}
+		}
+	})
+
+	t.Run("lists the keys of a store", func(t *testing.T) {
+		elements, err := reader.ListElements(url.URL{Scheme: "sops", Host: "prod", Path: "/db/"})
+		if err != nil {
+			t.Fatalf("ListElements failed: %v", err)
+		}
+		if got := elementNames(elements); !slices.Equal(got, []string{"password"}) {
+			t.Errorf("Expected [password], got %v", got)
+		}
+	})
+
+	t.Run("records the files of the stores read", func(t *testing.T) {
+		if _, ok := reads.files[stores["prod"]]; !ok {
+			t.Errorf("Expected %s recorded, got %v", stores["prod"], reads.files)
+		}
+	})
+
+	t.Run("fails on unknown stores", func(t *testing.T) {
+		_, err := reader.Read(url.URL{Scheme: "sops", Host: "dev", Path: "/db/password"})
+		var unknown *UnknownSecretStoreError
+		if !errors.As(err, &unknown) || unknown.Name != "dev" {
+			t.Errorf("Expected UnknownSecretStoreError, got: %v", err)
+		}
+	})
+}
@@ -0,0 +1,259 @@
+package render
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/apple/pkl-go/pkl"
+	"github.com/fsnotify/fsnotify"
+	"github.com/niule-eu/hlcli/pkg/framework"
+)
+
+// resourceReads records what the resource readers of an evaluator read. A
+// nil *resourceReads records nothing.
+type resourceReads struct {
+	mu      sync.Mutex
+	files   map[string]struct{}
+	secrets bool
+}
+
+func (r *resourceReads) addFile(path string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.files == nil {
+		r.files = map[string]struct{}{}
+	}
+	r.files[path] = struct{}{}
+}
+
+func (r *resourceReads) addSecrets() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.secrets = true
+}
+
+func (r *resourceReads) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.files = nil
+	r.secrets = false
+}
+
+// Dependencies returns the local files the last render depends on: the
+// module, the modules it imports, the PklProject and the files read through
+// sopsblob:, sopstar: and sopszip: resources. usesSecrets reports whether sops:
+// resources were read.
+func (r *Renderer) Dependencies(ctx context.Context) (files []string, usesSecrets bool, err error) {
+	files = []string{r.params.PklFile}
+	if r.projectRoot != "" {
+		files = append(files,
+			filepath.Join(r.projectRoot, "PklProject"),
+			filepath.Join(r.projectRoot, "PklProject.deps.json"),
+		)
+	}
+
+	imports, err := r.imports(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	files = append(files, imports...)
+
+	r.reads.mu.Lock()
+	for f := range r.reads.files {
+		files = append(files, f)
+	}
+	usesSecrets = r.reads.secrets
+	r.reads.mu.Unlock()
+
+	slices.Sort(files)
+	return slices.Compact(files), usesSecrets, nil
+}
+
+// imports returns the local modules imported by the module, directly or not,
+// using the import graph computed by pkl:analyze.
+func (r *Renderer) imports(ctx context.Context) ([]string, error) {
+	moduleUri := url.URL{Scheme: "file", Path: r.params.PklFile}
+	src := pkl.TextSource(fmt.Sprintf(
+		"import \"pkl:analyze\"\nresult = analyze.importGraph(Set(%q)).imports.keys.toList()\n",
+		moduleUri.String(),
+	))
+	var uris []string
+	if err := r.evaluator.EvaluateExpression(ctx, src, "result", &uris); err != nil {
+		return nil, fmt.Errorf("analyzing imports of %s: %w", r.params.PklFile, err)
+	}
+	var files []string
+	for _, u := range uris {
+		parsed, err := url.Parse(u)
+		if err != nil || parsed.Scheme != "file" {
+			continue
+		}
+		files = append(files, parsed.Path)
+	}
+	return files, nil
+}
+
+type WatchPklParams struct {
+	Debounce      time.Duration // Quiet period after a change before rendering again
+	SecretsPaths  []string      // Files behind sops: resources, watched once one is read
+	ReloadSecrets func() error  // Called before rendering again after a secrets file changed, if not nil
+}
+
+func NewDefaultWatchPklParams() *WatchPklParams {
+	return &WatchPklParams{
+		Debounce:     200 * time.Millisecond,
+		SecretsPaths: []string{},
+	}
+}
+
+// WatchPkl renders with r, then again whenever a file the last render
+// depends on changes, until ctx is done. apply is called with the effects
+// that would change a file on disk, or print something. Failed renders and
+// applies are logged, watching goes on until the files are fixed.
+func WatchPkl(
+	ctx context.Context,
+	r *Renderer,
+	params *WatchPklParams,
+	apply func(context.Context, ...framework.Effect) error,
+) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	watchedDirs := map[string]bool{}
+	for {
+		renderOnce(ctx, r, apply)
+
+		watched, err := watchedFiles(ctx, r, params)
+		if err != nil {
+			log.Printf("Watching the module only: %v", err)
+			watched = map[string]bool{r.params.PklFile: true}
+		}
+		// Editors often replace files instead of writing them, so watch
+		// the directories holding them
+		dirs := map[string]bool{}
+		for f := range watched {
+			dirs[filepath.Dir(f)] = true
+		}
+		for d := range watchedDirs {
+			if !dirs[d] {
+				watcher.Remove(d)
+			}
+		}
+		for d := range dirs {
+			if !watchedDirs[d] {
+				if err := watcher.Add(d); err != nil {
+					log.Printf("Cannot watch %s: %v", d, err)
+				}
+			}
+		}
+		watchedDirs = dirs
+
+		changed := waitForChanges(ctx, watcher, watched, params.Debounce)
+		if changed == nil {
+			return nil
+		}
+		log.Printf("Changed: %v, rendering again", changed)
+
+		if params.ReloadSecrets != nil && slices.ContainsFunc(changed, func(f string) bool {
+			return slices.Contains(params.SecretsPaths, f)
+		}) {
+			if err := params.ReloadSecrets(); err != nil {
+				log.Printf("Reloading secrets failed: %v", err)
+			}
+		}
+		if err := r.Refresh(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+// renderOnce renders and applies the effects that change something.
+func renderOnce(ctx context.Context, r *Renderer, apply func(context.Context, ...framework.Effect) error) {
+	effects, err := r.Render(ctx)
+	if err != nil {
+		log.Printf("Rendering %s failed: %v", r.params.PklFile, err)
+		return
+	}
+	changed, err := framework.Changed(effects...)
+	if err != nil {
+		log.Printf("Comparing output with the files on disk failed, writing everything: %v", err)
+		changed = effects
+	}
+	if len(changed) == 0 {
+		log.Printf("Output of %s unchanged", r.params.PklFile)
+		return
+	}
+	if err := apply(ctx, changed...); err != nil {
+		log.Printf("Applying output of %s failed: %v", r.params.PklFile, err)
+	}
+}
+
+// watchedFiles returns the absolute paths of the files to watch.
+func watchedFiles(ctx context.Context, r *Renderer, params *WatchPklParams) (map[string]bool, error) {
+	files, usesSecrets, err := r.Dependencies(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if usesSecrets {
+		files = append(files, params.SecretsPaths...)
+	}
+	watched := map[string]bool{}
+	for _, f := range files {
+		abs, err := filepath.Abs(f)
+		if err != nil {
+			return nil, err
+		}
+		watched[abs] = true
+	}
+	return watched, nil
+}
+
+// waitForChanges blocks until one of the watched files changes and no
+// further change happened for debounce. It returns the changed files, or nil
+// if ctx is done first.
+func waitForChanges(ctx context.Context, watcher *fsnotify.Watcher, watched map[string]bool, debounce time.Duration) []string {
+	var changed []string
+	var quiet <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-quiet:
+			slices.Sort(changed)
+			return slices.Compact(changed)
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if !watched[event.Name] || event.Op == fsnotify.Chmod {
+				continue
+			}
+			changed = append(changed, event.Name)
+			quiet = time.After(debounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			if err == fsnotify.ErrEventOverflow {
+				// Some events were lost, any file may have changed
+				return slices.Sorted(maps.Keys(watched))
+			}
+			log.Printf("Watch error: %v", err)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package render
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestWaitForChanges(t *testing.T) {
+	dir := t.TempDir()
+	module := filepath.Join(dir, "module.pkl")
+	other := filepath.Join(dir, "other.txt")
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+	if err := watcher.Add(dir); err != nil {
+		t.Fatal(err)
+	}
+	watched := map[string]bool{module: true}
+
+	t.Run("batches changes of watched files", func(t *testing.T) {
+		go func() {
+			for _, content := range []string{"a = 1", "a = 2"} {
+				os.WriteFile(other, []byte(content), 0644)
+				os.WriteFile(module, []byte(content), 0644)
+				time.Sleep(10 * time.Millisecond)
+			}
+		}()
+
+		changed := waitForChanges(context.Background(), watcher, watched, 100*time.Millisecond)
+		if !slices.Equal(changed, []string{module}) {
+			t.Errorf("Expected only %s to change, got %v", module, changed)
+		}
+	})
+
+	t.Run("returns nil once cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if changed := waitForChanges(ctx, watcher, watched, time.Millisecond); changed != nil {
+			t.Errorf("Expected nil, got %v", changed)
+		}
+	})
+}
@@ -2,6 +2,7 @@ package config
 
 import (
 	"fmt"
+	"path/filepath"
 	"strings"
 
 	"github.com/getsops/sops/v3/decrypt"
@@ -10,17 +11,20 @@ import (
 	"github.com/knadh/koanf/providers/file"
 	"github.com/knadh/koanf/providers/rawbytes"
 	"github.com/knadh/koanf/v2"
+	"github.com/niule-eu/hlcli/pkg/redact"
 )
 
 type LoadConfigParams struct {
 	Cfg             *koanf.Conf
 	EnvVarsPrefixes []string
 	CliConfigPaths  []string
+	PklRenderer     func(path string) ([]byte, error) // Renders .pkl configuration files as YAML, which are refused if nil
 }
 
 type LoadSecretsParams struct {
 	Cfg          *koanf.Conf
 	SecretsPaths []string
+	Redactor     *redact.Redactor // Every loaded value is registered for masking, nil to disable
 }
 
 func NewDefaultLoadConfigParams() *LoadConfigParams {
@@ -41,6 +45,7 @@ func NewDefaultLoadSecretsParams() *LoadSecretsParams {
 			StrictMerge: true,
 		},
 		SecretsPaths: []string{},
+		Redactor:     redact.Default,
 	}
 }
 
@@ -64,7 +69,18 @@ func LoadConfig(cfg *LoadConfigParams, final *koanf.Koanf, opts ...func(*LoadCon
 	fromFile := koanf.NewWithConf(*cfg.Cfg)
 	for _, p := range cfg.CliConfigPaths {
 		tmp := koanf.NewWithConf(*cfg.Cfg)
-		err := fromFile.Load(file.Provider(p), yaml.Parser())
+		var provider koanf.Provider = file.Provider(p)
+		if filepath.Ext(p) == ".pkl" {
+			if cfg.PklRenderer == nil {
+				return fmt.Errorf("cannot read Pkl configuration %s", p)
+			}
+			content, err := cfg.PklRenderer(p)
+			if err != nil {
+				return fmt.Errorf("reading configuration %s: %w", p, err)
+			}
+			provider = rawbytes.Provider(content)
+		}
+		err := fromFile.Load(provider, yaml.Parser())
 		if err != nil {
 			return err
 		}
@@ -95,11 +111,33 @@ func LoadSecrets(cfg *LoadSecretsParams, secrets *koanf.Koanf, opts ...func(*Loa
 		fromSops.Merge(tmp)
 	}
 
+	if cfg.Redactor != nil {
+		for _, v := range fromSops.All() {
+			registerSecret(cfg.Redactor, v)
+		}
+	}
 	secrets.Merge(fromSops)
 
 	return nil
 }
 
+// registerSecret adds a decrypted value, or every element of it, to r.
+func registerSecret(r *redact.Redactor, value any) {
+	switch v := value.(type) {
+	case nil:
+	case []any:
+		for _, e := range v {
+			registerSecret(r, e)
+		}
+	case map[string]any:
+		for _, e := range v {
+			registerSecret(r, e)
+		}
+	default:
+		r.Add(fmt.Sprint(v))
+	}
+}
+
 func SecretsToEnv(secrets *koanf.Koanf, prefix ...string) ([]string, error) {
 	out := []string{}
 	for _, key := range secrets.Keys() {
@@ -0,0 +1,433 @@
+package framework
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/getsops/sops/v3"
+	"github.com/getsops/sops/v3/keyservice"
+)
+
+// DiffStatus classifies how a file would change on disk.
+type DiffStatus string
+
+const (
+	DiffNew       DiffStatus = "new"
+	DiffModified  DiffStatus = "modified"
+	DiffUnchanged DiffStatus = "unchanged"
+	DiffDeleted   DiffStatus = "deleted"
+)
+
+// FileDiff is the difference between a file on disk and what an effect would
+// leave there.
+type FileDiff struct {
+	Path      string
+	Status    DiffStatus
+	Encrypted bool   // Compared against the decrypted content on disk
+	Unified   string // Unified diff, empty when Status is DiffUnchanged
+}
+
+func (d FileDiff) Changed() bool {
+	return d.Status != DiffUnchanged
+}
+
+// Differ is implemented by effects that can compare their outcome with what
+// is currently on disk.
+type Differ interface {
+	Diff() ([]FileDiff, error)
+}
+
+func (fw FileWriteIO) Diff() ([]FileDiff, error) {
+	return fw.diff(nil)
+}
+
+// diff compares the content fw would write with the file at fw.Path. When
+// encrypt is set, fw.Content is plaintext it will encrypt before writing, so
+// the file on disk is decrypted with its credentials before comparing.
+func (fw FileWriteIO) diff(encrypt *SopsEncryptEffect) ([]FileDiff, error) {
+	encrypted := encrypt != nil
+	// Output to a standard stream changes nothing on disk
+	if isStreamPath(fw.Path) {
+		return nil, nil
+	}
+
+	var content []byte
+	if fw.Content != nil {
+		content = *fw.Content
+	}
+
+	existing, err := os.ReadFile(fw.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return []FileDiff{{
+			Path:      fw.Path,
+			Status:    DiffNew,
+			Encrypted: encrypted,
+			Unified:   unifiedDiff(nil, content, "/dev/null", fw.Path),
+		}}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if encrypted {
+		cleartext, err := runSops(context.Background(), encrypt.Timeout, encrypt.EnvVars, func(svcs []keyservice.KeyServiceClient) ([]byte, error) {
+			return sopsDecrypt(existing, fw.Path, svcs)
+		})
+		if err == nil {
+			existing = cleartext
+		} else if !errors.Is(err, sops.MetadataNotFound) {
+			return nil, fmt.Errorf("decrypting %s for diff: %w", fw.Path, err)
+		}
+	}
+
+	if bytes.Equal(existing, content) {
+		return []FileDiff{{Path: fw.Path, Status: DiffUnchanged, Encrypted: encrypted}}, nil
+	}
+	return []FileDiff{{
+		Path:      fw.Path,
+		Status:    DiffModified,
+		Encrypted: encrypted,
+		Unified:   unifiedDiff(existing, content, fw.Path, fw.Path),
+	}}, nil
+}
+
+func (fdio *FileDeleteIO) Diff() ([]FileDiff, error) {
+	existing, err := os.ReadFile(fdio.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return []FileDiff{{
+		Path:    fdio.Path,
+		Status:  DiffDeleted,
+		Unified: unifiedDiff(existing, nil, fdio.Path, "/dev/null"),
+	}}, nil
+}
+
+// Diff pairs every SopsEncryptEffect with the FileWriteIO writing the same
+// buffer, so encrypted targets are compared by their decrypted content.
+// Content no creation rule matches is written, and compared, as plaintext.
+func (fw CompoundEffect) Diff() ([]FileDiff, error) {
+	encrypted := map[*[]byte]*SopsEncryptEffect{}
+	var diffs []FileDiff
+	for _, e := range fw.Effects {
+		switch e := e.(type) {
+		case *SopsEncryptEffect:
+			if e.encrypts() {
+				encrypted[e.Plaintext] = e
+			}
+		case *FileWriteIO:
+			d, err := e.diff(encrypted[e.Content])
+			if err != nil {
+				return nil, err
+			}
+			diffs = append(diffs, d...)
+		default:
+			d, err := Diff(e)
+			if err != nil {
+				return nil, err
+			}
+			diffs = append(diffs, d...)
+		}
+	}
+	return diffs, nil
+}
+
+// Diff compares the outcome of the given effects with the current state of
+// the disk without applying them. Effects that do not touch files, or do not
+// implement Differ, contribute nothing.
+func Diff(effect ...Effect) ([]FileDiff, error) {
+	var diffs []FileDiff
+	for _, e := range effect {
+		if d, ok := e.(Differ); ok {
+			fileDiffs, err := d.Diff()
+			if err != nil {
+				return nil, err
+			}
+			diffs = append(diffs, fileDiffs...)
+		}
+	}
+	return diffs, nil
+}
+
+// Changed returns the effects that would change a file on disk, dropping the
+// ones leaving every file they touch unchanged. Effects that do not touch
+// files (e.g. output to stdout) are kept, unless they depend on effects that
+// are all dropped: these would apply to an unchanged outcome. Effects
+// depending on a kept effect are kept, and lose their dependencies on dropped
+// ones, whose outcome already is on disk.
+func Changed(effect ...Effect) ([]Effect, error) {
+	deps := make([][]int, len(effect))
+	keep := make([]bool, len(effect))
+	for i, e := range effect {
+		if d, ok := e.(Dependent); ok {
+			for _, dep := range d.DependsOn() {
+				if j := slices.IndexFunc(effect, func(other Effect) bool { return sameEffect(other, dep) }); j != -1 {
+					deps[i] = append(deps[i], j)
+				}
+			}
+		}
+		diffs, err := Diff(e)
+		if err != nil {
+			return nil, err
+		}
+		keep[i] = slices.ContainsFunc(diffs, FileDiff.Changed) || (len(diffs) == 0 && len(deps[i]) == 0)
+	}
+	for propagated := true; propagated; {
+		propagated = false
+		for i := range effect {
+			if !keep[i] && slices.ContainsFunc(deps[i], func(j int) bool { return keep[j] }) {
+				keep[i] = true
+				propagated = true
+			}
+		}
+	}
+
+	// Kept effects with dependencies are copied, the copies depending on
+	// the copies of their kept dependencies
+	changed := make([]Effect, len(effect))
+	for i, e := range effect {
+		if d, ok := e.(*DependentEffect); ok && keep[i] {
+			changed[i] = &DependentEffect{Effect: d.Effect}
+		} else {
+			changed[i] = e
+		}
+	}
+	for i, e := range changed {
+		if d, ok := e.(*DependentEffect); ok && keep[i] {
+			for _, j := range deps[i] {
+				if keep[j] {
+					d.Dependencies = append(d.Dependencies, changed[j])
+				}
+			}
+		}
+	}
+	var kept []Effect
+	for i, e := range changed {
+		if keep[i] {
+			kept = append(kept, e)
+		}
+	}
+	return kept, nil
+}
+
+// DiffEffect writes the changes the wrapped effects would make to disk,
+// instead of applying them. After Apply, Changes holds the number of files
+// that would be created, modified or deleted.
+type DiffEffect struct {
+	Effects []Effect
+	Out     io.Writer
+	Changes int
+}
+
+func NewDiffEffect(out io.Writer, effects ...Effect) *DiffEffect {
+	return &DiffEffect{
+		Effects: effects,
+		Out:     out,
+	}
+}
+
+func (de *DiffEffect) Apply() error {
+	diffs, err := Diff(de.Effects...)
+	if err != nil {
+		return err
+	}
+	de.Changes = 0
+	for _, d := range diffs {
+		label := string(d.Status)
+		if d.Encrypted {
+			label += ", sops"
+		}
+		if _, err := fmt.Fprintf(de.Out, "%s (%s)\n", d.Path, label); err != nil {
+			return err
+		}
+		if !d.Changed() {
+			continue
+		}
+		de.Changes++
+		if _, err := io.WriteString(de.Out, d.Unified); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diffContext is the number of unchanged lines shown around each change.
+const diffContext = 3
+
+// maxDiffCells bounds the size of the LCS table; larger inputs are shown as a
+// single replacement hunk.
+const maxDiffCells = 4_000_000
+
+type diffOp struct {
+	kind byte // ' ', '-' or '+'
+	line string
+}
+
+// unifiedDiff renders the line-based difference between a and b in unified
+// diff format.
+func unifiedDiff(a, b []byte, fromName, toName string) string {
+	ops := diffLines(splitLines(a), splitLines(b))
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", fromName, toName)
+
+	// Walk the edit script, emitting hunks of changes with diffContext lines
+	// of context around them.
+	aLine, bLine := 1, 1
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			aLine++
+			bLine++
+			continue
+		}
+
+		start := max(i-diffContext, 0)
+		for j := start; j < i; j++ {
+			aLine--
+			bLine--
+		}
+
+		// Extend the hunk until more than 2*diffContext unchanged lines
+		// separate it from the next change.
+		end := i
+		for end < len(ops) {
+			if ops[end].kind != ' ' {
+				end++
+				continue
+			}
+			run := end
+			for run < len(ops) && ops[run].kind == ' ' {
+				run++
+			}
+			if run == len(ops) || run-end > 2*diffContext {
+				end = min(end+diffContext, len(ops))
+				break
+			}
+			end = run
+		}
+
+		aCount, bCount := 0, 0
+		for _, op := range ops[start:end] {
+			if op.kind != '+' {
+				aCount++
+			}
+			if op.kind != '-' {
+				bCount++
+			}
+		}
+		fmt.Fprintf(&sb, "@@ -%s +%s @@\n", hunkRange(aLine, aCount), hunkRange(bLine, bCount))
+		for _, op := range ops[start:end] {
+			sb.WriteByte(op.kind)
+			sb.WriteString(op.line)
+			sb.WriteByte('\n')
+		}
+
+		aLine += aCount
+		bLine += bCount
+		i = end
+	}
+	return sb.String()
+}
+
+func hunkRange(line, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", line-1)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", line)
+	}
+	return fmt.Sprintf("%d,%d", line, count)
+}
+
+// noNewline marks a last line without a trailing newline. It is kept in the
+// line so that it differs from the same line with one, and is printed with it.
+const noNewline = "\n\\ No newline at end of file"
+
+func splitLines(b []byte) []string {
+	if len(b) == 0 {
+		return nil
+	}
+	s, terminated := strings.CutSuffix(string(b), "\n")
+	lines := strings.Split(s, "\n")
+	if !terminated {
+		lines[len(lines)-1] += noNewline
+	}
+	return lines
+}
+
+// diffLines computes an edit script turning a into b using the longest common
+// subsequence of lines, after trimming the common prefix and suffix.
+func diffLines(a, b []string) []diffOp {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var ops []diffOp
+	for _, l := range a[:prefix] {
+		ops = append(ops, diffOp{' ', l})
+	}
+
+	ma, mb := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	if len(ma)*len(mb) > maxDiffCells {
+		for _, l := range ma {
+			ops = append(ops, diffOp{'-', l})
+		}
+		for _, l := range mb {
+			ops = append(ops, diffOp{'+', l})
+		}
+	} else {
+		// lcs[i][j] is the LCS length of ma[i:] and mb[j:]
+		lcs := make([][]int, len(ma)+1)
+		for i := range lcs {
+			lcs[i] = make([]int, len(mb)+1)
+		}
+		for i := len(ma) - 1; i >= 0; i-- {
+			for j := len(mb) - 1; j >= 0; j-- {
+				if ma[i] == mb[j] {
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				} else {
+					lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+				}
+			}
+		}
+		i, j := 0, 0
+		for i < len(ma) && j < len(mb) {
+			switch {
+			case ma[i] == mb[j]:
+				ops = append(ops, diffOp{' ', ma[i]})
+				i++
+				j++
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				ops = append(ops, diffOp{'-', ma[i]})
+				i++
+			default:
+				ops = append(ops, diffOp{'+', mb[j]})
+				j++
+			}
+		}
+		for ; i < len(ma); i++ {
+			ops = append(ops, diffOp{'-', ma[i]})
+		}
+		for ; j < len(mb); j++ {
+			ops = append(ops, diffOp{'+', mb[j]})
+		}
+	}
+
+	for _, l := range a[len(a)-suffix:] {
+		ops = append(ops, diffOp{' ', l})
+	}
+	return ops
+}
@@ -0,0 +1,235 @@
+package framework
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	testutils "github.com/niule-eu/hlcli/test"
+)
+
+func TestDiff(t *testing.T) {
+	dir := t.TempDir()
+
+	t.Run("marks new, modified, unchanged and deleted files", func(t *testing.T) {
+		newFile := filepath.Join(dir, "new.yaml")
+		modifiedFile := filepath.Join(dir, "modified.yaml")
+		unchangedFile := filepath.Join(dir, "unchanged.yaml")
+		deletedFile := filepath.Join(dir, "deleted.yaml")
+		for _, p := range []string{modifiedFile, unchangedFile, deletedFile} {
+			if err := os.WriteFile(p, []byte("a: 1\nb: 2\n"), 0644); err != nil {
+				t.Fatalf("Failed to create %s: %v", p, err)
+			}
+		}
+
+		same := []byte("a: 1\nb: 2\n")
+		changed := []byte("a: 1\nb: 3\n")
+		diffs, err := Diff(
+			NewDefaultFileWriteIO(newFile, &same),
+			NewDefaultFileWriteIO(modifiedFile, &changed),
+			NewDefaultFileWriteIO(unchangedFile, &same),
+			&FileDeleteIO{Path: deletedFile, Op: os.Remove},
+		)
+		if err != nil {
+			t.Fatalf("Diff() failed: %v", err)
+		}
+
+		expected := []DiffStatus{DiffNew, DiffModified, DiffUnchanged, DiffDeleted}
+		if len(diffs) != len(expected) {
+			t.Fatalf("Expected %d diffs, got %d", len(expected), len(diffs))
+		}
+		for i, status := range expected {
+			if diffs[i].Status != status {
+				t.Errorf("Expected diff %d to be %s, got %s", i, status, diffs[i].Status)
+			}
+		}
+		if !strings.Contains(diffs[1].Unified, "-b: 2\n+b: 3\n") {
+			t.Errorf("Unexpected unified diff:\n%s", diffs[1].Unified)
+		}
+		if _, err := os.Stat(newFile); !os.IsNotExist(err) {
+			t.Error("Expected Diff() not to create files")
+		}
+		if _, err := os.Stat(deletedFile); err != nil {
+			t.Error("Expected Diff() not to delete files")
+		}
+	})
+
+	t.Run("counts pending changes", func(t *testing.T) {
+		unchangedFile := filepath.Join(dir, "count.yaml")
+		content := []byte("key: value\n")
+		if err := os.WriteFile(unchangedFile, content, 0644); err != nil {
+			t.Fatalf("Failed to create %s: %v", unchangedFile, err)
+		}
+
+		var out bytes.Buffer
+		effect := NewDiffEffect(&out, NewDefaultFileWriteIO(unchangedFile, &content))
+		if err := effect.Apply(); err != nil {
+			t.Fatalf("Apply() failed: %v", err)
+		}
+		if effect.Changes != 0 {
+			t.Errorf("Expected no changes, got %d:\n%s", effect.Changes, out.String())
+		}
+
+		changed := []byte("key: other\n")
+		effect = NewDiffEffect(&out, NewDefaultFileWriteIO(unchangedFile, &changed))
+		if err := effect.Apply(); err != nil {
+			t.Fatalf("Apply() failed: %v", err)
+		}
+		if effect.Changes != 1 {
+			t.Errorf("Expected 1 change, got %d", effect.Changes)
+		}
+	})
+}
+
+func TestDiffSopsEncrypted(t *testing.T) {
+	execEnv := testutils.NewSopsExecEnv(t)
+	// Only the effects hold the age key
+	t.Setenv("SOPS_AGE_KEY", "")
+	t.Setenv("SOPS_AGE_KEY_FILE", "")
+
+	target := execEnv.GetYamlPath()
+	original := []byte("password: hunter2\n")
+	err := CompoundEffect{
+		Effects: []Effect{
+			NewSopsEncryptEffect(&original, "", target, execEnv.EnvVars),
+			NewDefaultFileWriteIO(target, &original),
+		},
+	}.Apply()
+	if err != nil {
+		t.Fatalf("Failed to write encrypted file: %v", err)
+	}
+
+	t.Run("compares decrypted content", func(t *testing.T) {
+		plaintext := []byte("password: hunter2\n")
+		diffs, err := Diff(CompoundEffect{
+			Effects: []Effect{
+				NewSopsEncryptEffect(&plaintext, "", target, execEnv.EnvVars),
+				NewDefaultFileWriteIO(target, &plaintext),
+			},
+		})
+		if err != nil {
+			t.Fatalf("Diff() failed: %v", err)
+		}
+		if len(diffs) != 1 || diffs[0].Status != DiffUnchanged || !diffs[0].Encrypted {
+			t.Errorf("Expected one unchanged encrypted diff, got %+v", diffs)
+		}
+
+		changed := []byte("password: hunter3\n")
+		diffs, err = Diff(CompoundEffect{
+			Effects: []Effect{
+				NewSopsEncryptEffect(&changed, "", target, execEnv.EnvVars),
+				NewDefaultFileWriteIO(target, &changed),
+			},
+		})
+		if err != nil {
+			t.Fatalf("Diff() failed: %v", err)
+		}
+		if len(diffs) != 1 || diffs[0].Status != DiffModified {
+			t.Fatalf("Expected one modified diff, got %+v", diffs)
+		}
+		if !strings.Contains(diffs[0].Unified, "-password: hunter2\n+password: hunter3\n") {
+			t.Errorf("Expected diff of decrypted content, got:\n%s", diffs[0].Unified)
+		}
+	})
+}
+
+func TestChanged(t *testing.T) {
+	dir := t.TempDir()
+	unchangedFile := filepath.Join(dir, "unchanged.yaml")
+	if err := os.WriteFile(unchangedFile, []byte("a: 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	same := []byte("a: 1\n")
+	changed := []byte("a: 2\n")
+	modify := NewDefaultFileWriteIO(unchangedFile, &changed)
+	create := NewDefaultFileWriteIO(filepath.Join(dir, "new.yaml"), &same)
+	message := NewStdOutIO("done")
+	effects, err := Changed(
+		NewDefaultFileWriteIO(unchangedFile, &same),
+		modify,
+		create,
+		message,
+	)
+	if err != nil {
+		t.Fatalf("Changed() failed: %v", err)
+	}
+	expected := []Effect{modify, create, message}
+	if len(effects) != len(expected) {
+		t.Fatalf("Expected %d effects, got %d", len(expected), len(effects))
+	}
+	for i := range expected {
+		if effects[i] != expected[i] {
+			t.Errorf("Expected effect %d to be %+v, got %+v", i, expected[i], effects[i])
+		}
+	}
+}
+
+func TestChangedDependencies(t *testing.T) {
+	dir := t.TempDir()
+	unchangedFile := filepath.Join(dir, "unchanged.yaml")
+	if err := os.WriteFile(unchangedFile, []byte("a: 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	same := []byte("a: 1\n")
+	changed := []byte("a: 2\n")
+	unchanged := NewDefaultFileWriteIO(unchangedFile, &same)
+	modify := NewDefaultFileWriteIO(filepath.Join(dir, "modified.yaml"), &changed)
+
+	var log []string
+	var mu sync.Mutex
+	afterUnchanged := After(&recordingEffect{name: "after unchanged", log: &log, mu: &mu}, unchanged)
+	afterBoth := After(&recordingEffect{name: "after both", log: &log, mu: &mu}, unchanged, modify)
+	afterAfterBoth := After(&recordingEffect{name: "after after both", log: &log, mu: &mu}, afterBoth)
+
+	effects, err := Changed(unchanged, modify, afterUnchanged, afterBoth, afterAfterBoth)
+	if err != nil {
+		t.Fatalf("Changed() failed: %v", err)
+	}
+	if len(effects) != 3 || effects[0] != modify {
+		t.Fatalf("Expected the modification and its dependents, got %+v", effects)
+	}
+	if err := Invoke(context.Background(), effects...); err != nil {
+		t.Fatalf("Invoke() failed: %v", err)
+	}
+	if len(log) != 2 || log[0] != "after both" || log[1] != "after after both" {
+		t.Errorf("Expected [after both after after both], got %v", log)
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	var a, b []string
+	for i := 1; i <= 20; i++ {
+		a = append(a, strings.Repeat("x", i))
+	}
+	b = append(b, a...)
+	b[1] = "changed"
+	b[17] = "also changed"
+
+	got := unifiedDiff([]byte(strings.Join(a, "\n")+"\n"), []byte(strings.Join(b, "\n")+"\n"), "a", "b")
+	if strings.Count(got, "@@ -") != 2 {
+		t.Errorf("Expected 2 hunks, got:\n%s", got)
+	}
+	if !strings.Contains(got, "@@ -1,5 +1,5 @@\n") || !strings.Contains(got, "@@ -15,6 +15,6 @@\n") {
+		t.Errorf("Unexpected hunk headers:\n%s", got)
+	}
+}
+
+func TestUnifiedDiffMissingNewline(t *testing.T) {
+	for _, tc := range []struct {
+		a, b     string
+		expected string
+	}{
+		{a: "a\nb", b: "a\nb\n", expected: "--- a\n+++ b\n@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+b\n"},
+		{a: "a\nb\n", b: "a\nb", expected: "--- a\n+++ b\n@@ -1,2 +1,2 @@\n a\n-b\n+b\n\\ No newline at end of file\n"},
+		{a: "a\nb", b: "c\nb", expected: "--- a\n+++ b\n@@ -1,2 +1,2 @@\n-a\n+c\n b\n\\ No newline at end of file\n"},
+	} {
+		if got := unifiedDiff([]byte(tc.a), []byte(tc.b), "a", "b"); got != tc.expected {
+			t.Errorf("%q to %q: expected:\n%s\ngot:\n%s", tc.a, tc.b, tc.expected, got)
+		}
+	}
+}
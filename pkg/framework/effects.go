@@ -2,67 +2,238 @@ package framework
 
 import (
 	"bufio"
-	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"log"
+	"math/rand/v2"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
 
 	sopsConfig "github.com/getsops/sops/v3/config"
+	"github.com/getsops/sops/v3/keyservice"
 )
 
 type Effect interface {
 	Apply() error
 }
 
+// ContextEffect is implemented by effects that can be cancelled through a
+// context, e.g. ones running subprocesses or network calls.
+type ContextEffect interface {
+	Effect
+	ApplyContext(ctx context.Context) error
+}
+
+// contextAdapter lets an Effect that does not know about contexts be used as
+// a ContextEffect. It refuses to start once the context is done.
+type contextAdapter struct {
+	Effect
+}
+
+func (a contextAdapter) ApplyContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.Apply()
+}
+
+// WithContext returns e as a ContextEffect, adapting it if needed.
+func WithContext(e Effect) ContextEffect {
+	if ce, ok := e.(ContextEffect); ok {
+		return ce
+	}
+	return contextAdapter{e}
+}
+
 // EffectContext provides common fields for IO operations
 // Implementors of Effect interface can embed this struct to get EnvVars field
 type EffectContext struct {
 	EnvVars map[string]string // Environment variables for the operation
 }
 
+// FileWriteIO writes Content to Path. By default the content is written to a
+// temporary file next to Path which is then renamed over it, so an
+// interrupted write never leaves a truncated file behind.
+// Writes go directly to Path, using Mode, when Direct is set, when Mode asks
+// for O_APPEND, when Path names a standard stream (e.g. /dev/stdout), or when
+// Path exists and is not a regular file.
+// A zero Permissions keeps the mode of an existing Path and creates new files
+// with DefaultPermissions. Like any created file, those get the permissions
+// that the umask leaves, only the mode kept from an existing Path is exact.
 type FileWriteIO struct {
 	Path        string
 	Content     *[]byte
 	Mode        int
 	Permissions os.FileMode
+	Direct      bool // Write in place instead of replacing atomically
 }
 
+// DefaultPermissions is the mode of files created by a FileWriteIO without
+// Permissions.
+const DefaultPermissions os.FileMode = 0644
+
 func NewDefaultFileWriteIO(path string, content *[]byte) *FileWriteIO {
 	return &FileWriteIO{
-		Path:        path,
-		Content:     content,
-		Mode:        os.O_CREATE | os.O_WRONLY | os.O_TRUNC,
-		Permissions: 0644,
+		Path:    path,
+		Content: content,
+		Mode:    os.O_CREATE | os.O_WRONLY | os.O_TRUNC,
 	}
 }
 
 func NewFileWriteIOWithRef(path string, content *[]byte) *FileWriteIO {
 	return &FileWriteIO{
-		Path:        path,
-		Content:     content,
-		Mode:        os.O_CREATE | os.O_WRONLY | os.O_TRUNC,
-		Permissions: 0644,
+		Path:    path,
+		Content: content,
+		Mode:    os.O_CREATE | os.O_WRONLY | os.O_TRUNC,
+	}
+}
+
+// streamFile returns the standard stream path refers to, or nil. Writing to
+// the stream itself, rather than opening path, keeps whatever was already
+// written when it is redirected to a regular file.
+func streamFile(path string) *os.File {
+	switch path {
+	case "/dev/stdout", "/dev/fd/1", "/proc/self/fd/1":
+		return os.Stdout
+	case "/dev/stderr", "/dev/fd/2", "/proc/self/fd/2":
+		return os.Stderr
+	}
+	return nil
+}
+
+func isStreamPath(path string) bool {
+	return streamFile(path) != nil
+}
+
+// permissions returns the mode Path gets: Permissions if set, else the mode
+// of the existing file, else DefaultPermissions. existing tells whether the
+// mode is kept from the existing file.
+func (fw FileWriteIO) permissions() (perm os.FileMode, existing bool) {
+	if fw.Permissions != 0 {
+		return fw.Permissions, false
 	}
+	if info, err := os.Stat(fw.Path); err == nil {
+		return info.Mode().Perm(), true
+	}
+	return DefaultPermissions, false
 }
 
 func (fw FileWriteIO) Apply() error {
-	f, err := os.OpenFile(fw.Path, fw.Mode, fw.Permissions)
+	if fw.Direct || fw.Mode&os.O_APPEND != 0 || isStreamPath(fw.Path) {
+		return fw.writeDirect()
+	}
+	target := fw.Path
+	if info, err := os.Stat(fw.Path); err == nil {
+		if !info.Mode().IsRegular() {
+			return fw.writeDirect()
+		}
+		// Replace the file a symlink points to, not the symlink itself
+		if target, err = filepath.EvalSymlinks(fw.Path); err != nil {
+			return err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return fw.writeAtomic(target)
+}
+
+func (fw FileWriteIO) writeDirect() error {
+	if stream := streamFile(fw.Path); stream != nil {
+		_, err := stream.Write(*fw.Content)
+		return err
+	}
+	perm, _ := fw.permissions()
+	f, err := os.OpenFile(fw.Path, fw.Mode, perm)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 
 	buf := bufio.NewWriter(f)
-	_, err = buf.Write(*fw.Content)
+	if _, err := buf.Write(*fw.Content); err != nil {
+		f.Close()
+		return err
+	}
+	if err := buf.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	// Character devices and pipes cannot be synced
+	if info, err := f.Stat(); err == nil && info.Mode().IsRegular() {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+func (fw FileWriteIO) writeAtomic(target string) (err error) {
+	dir := filepath.Dir(target)
+	perm, existing := fw.permissions()
+	tmp, err := createTemp(dir, "."+filepath.Base(target)+".tmp-", perm)
 	if err != nil {
 		return err
 	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
 
-	f.Sync()
-	buf.Flush()
-	return nil
+	if existing {
+		if err = tmp.Chmod(perm); err != nil {
+			return err
+		}
+	}
+	buf := bufio.NewWriter(tmp)
+	if _, err = buf.Write(*fw.Content); err != nil {
+		return err
+	}
+	if err = buf.Flush(); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), target); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// createTemp creates a new file in dir, named prefix followed by a random
+// string. Unlike os.CreateTemp, the file is created with perm, so that the
+// umask applies to it as to any file created in place.
+func createTemp(dir string, prefix string, perm os.FileMode) (*os.File, error) {
+	for range 10000 {
+		name := filepath.Join(dir, prefix+strconv.FormatUint(uint64(rand.Uint32()), 10))
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, perm)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		return f, err
+	}
+	return nil, &os.PathError{Op: "createtemp", Path: filepath.Join(dir, prefix+"*"), Err: os.ErrExist}
+}
+
+// syncDir flushes directory entries, making a preceding rename durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := d.Sync(); err != nil {
+		d.Close()
+		return err
+	}
+	return d.Close()
 }
 
 type FileDeleteIO struct {
@@ -99,37 +270,44 @@ type CompoundEffect struct {
 	Effects []Effect
 }
 
+// Apply applies the effects in order and stops at the first failure, since
+// later effects usually depend on earlier ones (e.g. encrypt then write).
 func (fw CompoundEffect) Apply() error {
-	var errs []error
+	return fw.ApplyContext(context.Background())
+}
+
+func (fw CompoundEffect) ApplyContext(ctx context.Context) error {
 	for _, e := range fw.Effects {
-		if err := e.Apply(); err != nil {
-			errs = append(errs, err)
+		if err := WithContext(e).ApplyContext(ctx); err != nil {
+			return err
 		}
 	}
-	if len(errs) != 0 {
-		return errors.Join(errs...)
-	}
 	return nil
 }
 
-// SopsEncryptEffect encrypts content using the SOPS binary
+// SopsEncryptEffect encrypts content in-process with the SOPS library.
 // It takes a reference to a byte slice containing plaintext and replaces it
-// with the encrypted ciphertext in-place. The effect handles:
-// 1. Checking SOPS binary availability
-// 2. Executing SOPS encryption subprocess
-// 3. Piping plaintext to SOPS via stdin
-// 4. Capturing encrypted output from SOPS stdout
-// 5. Replacing plaintext with ciphertext in the byte slice
-// 6. Error handling and cleanup
+// with the encrypted ciphertext in-place. The creation rule matching
+// FilenameOverride in the SOPS configuration decides which keys are used and
+// which values are encrypted, as with `sops encrypt --filename-override`.
+// When Original is set, its keys and settings are reused instead, as when
+// saving a file opened with `sops edit`.
 // Note: This effect ONLY handles in-memory encryption. File writing is handled
 // separately by FileWriteIO to maintain separation of concerns.
 type SopsEncryptEffect struct {
 	EffectContext
-	Plaintext        *[]byte // Reference to plaintext content in memory
-	ConfigPath       string  // Optional path to SOPS configuration file
-	FilenameOverride string  // Filename override for SOPS (required when using stdin)
+	Plaintext        *[]byte       // Reference to plaintext content in memory
+	ConfigPath       string        // Optional path to SOPS configuration file
+	FilenameOverride string        // Path used to match creation rules and pick the file format
+	Original         []byte        // Optional encrypted document whose keys are reused
+	Rule             *SopsRule     // Optional overrides of the matching creation rule
+	Timeout          time.Duration // Limit for the encryption, DefaultSopsTimeout if zero
 }
 
+// DefaultSopsTimeout bounds a single SOPS operation, which may have to reach
+// a remote KMS.
+const DefaultSopsTimeout = 2 * time.Minute
+
 // NewSopsEncryptEffect creates a new SopsEncryptEffect with default values
 // Uses "encrypted.json" as the default filename override
 func NewDefaultSopsEncryptEffect(plaintext *[]byte) *SopsEncryptEffect {
@@ -156,81 +334,265 @@ func NewSopsEncryptEffect(plaintext *[]byte, configPath string, filenameOverride
 	}
 }
 
-// Apply encrypts the plaintext content using the SOPS binary.
-// It pipes the plaintext to SOPS via stdin and captures the encrypted output from stdout,
-// replacing the original plaintext with ciphertext in-place.
-// If SOPS binary is not found or encryption fails, the original content is preserved.
+// configPath resolves the SOPS configuration file used for encryption.
+// An explicit ConfigPath wins over SOPS_CONFIG from EnvVars, which wins over
+// a .sops.yaml discovered from the working directory.
+func (e *SopsEncryptEffect) configPath() string {
+	return sopsConfigPath(e.ConfigPath, e.EffectContext.EnvVars)
+}
+
+// encrypts reports whether applying e encrypts its plaintext, rather than
+// leaving it unencrypted because no creation rule matches FilenameOverride.
+// Other failures to load the rule are left to ApplyContext.
+func (e *SopsEncryptEffect) encrypts() bool {
+	if e.Original != nil || e.Rule != nil {
+		return true
+	}
+	_, err := loadCreationRule(e.configPath(), e.FilenameOverride)
+	var noRule *NoMatchingCreationRuleError
+	return !errors.As(err, &noRule)
+}
+
 func (e *SopsEncryptEffect) Apply() error {
-	// Check if SOPS binary is available
-	if _, err := exec.LookPath("sops"); err != nil {
-		return fmt.Errorf("sops binary not found in PATH: %w", err)
+	return e.ApplyContext(context.Background())
+}
+
+// ApplyContext encrypts the plaintext content, replacing it with ciphertext
+// in-place. EnvVars hold credentials handed to the SOPS key sources (e.g.
+// SOPS_AGE_KEY or AWS_ACCESS_KEY_ID), the process environment is left
+// untouched. The encryption is cancelled when ctx is done or Timeout
+// elapses. If no creation rule matches FilenameOverride, the content is left
+// unencrypted, unless a Rule requested its encryption. On error, the original
+// content is preserved.
+func (e *SopsEncryptEffect) ApplyContext(ctx context.Context) error {
+	var encrypt func(svcs []keyservice.KeyServiceClient) ([]byte, error)
+	if e.Original != nil {
+		encrypt = func(svcs []keyservice.KeyServiceClient) ([]byte, error) {
+			return sopsReencrypt(e.Original, *e.Plaintext, e.FilenameOverride, svcs)
+		}
+	} else {
+		sopsConfigPath := e.configPath()
+		var conf *sopsConfig.Config
+		var err error
+		if e.Rule != nil {
+			conf, err = e.Rule.creationRule(sopsConfigPath, e.FilenameOverride)
+		} else {
+			conf, err = loadCreationRule(sopsConfigPath, e.FilenameOverride)
+		}
+		var noRule *NoMatchingCreationRuleError
+		if errors.As(err, &noRule) && e.Rule == nil {
+			log.Default().Printf("No creation rule found in %s for path %s, leaving file unencrypted.", sopsConfigPath, e.FilenameOverride)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("sops encryption of %s failed: %w", e.FilenameOverride, err)
+		}
+		encrypt = func(svcs []keyservice.KeyServiceClient) ([]byte, error) {
+			return sopsEncrypt(*e.Plaintext, e.FilenameOverride, sopsConfigPath, conf, svcs)
+		}
 	}
 
-	// Build SOPS command - use 'encrypt' as subcommand
-	args := []string{}
+	ciphertext, err := runSops(ctx, e.Timeout, e.EffectContext.EnvVars, encrypt)
+	if err != nil {
+		return fmt.Errorf("sops encryption of %s failed: %w", e.FilenameOverride, err)
+	}
+	*e.Plaintext = ciphertext
+	return nil
+}
+
+// SopsDecryptEffect decrypts a SOPS-encrypted document in-process, replacing
+// the ciphertext with plaintext in-place. The format of the document is
+// derived from FilenameOverride. On error, the ciphertext is preserved.
+type SopsDecryptEffect struct {
+	EffectContext
+	Ciphertext       *[]byte       // Reference to encrypted content in memory
+	FilenameOverride string        // Path of the document, used to pick the file format
+	Timeout          time.Duration // Limit for the decryption, DefaultSopsTimeout if zero
+}
 
-	sopsConfigPath := ""
-	discoveredConfig, err := sopsConfig.FindConfigFile(".")
-	if err == nil {
-		sopsConfigPath = discoveredConfig
+func NewSopsDecryptEffect(ciphertext *[]byte, filenameOverride string, envVars map[string]string) *SopsDecryptEffect {
+	return &SopsDecryptEffect{
+		EffectContext: EffectContext{
+			EnvVars: envVars,
+		},
+		Ciphertext:       ciphertext,
+		FilenameOverride: filenameOverride,
 	}
+}
+
+func (e *SopsDecryptEffect) Apply() error {
+	return e.ApplyContext(context.Background())
+}
 
-	if e.EffectContext.EnvVars["SOPS_CONFIG"] != "" {
-		sopsConfigPath = e.EffectContext.EnvVars["SOPS_CONFIG"]
+func (e *SopsDecryptEffect) ApplyContext(ctx context.Context) error {
+	plaintext, err := runSops(ctx, e.Timeout, e.EffectContext.EnvVars, func(svcs []keyservice.KeyServiceClient) ([]byte, error) {
+		return sopsDecrypt(*e.Ciphertext, e.FilenameOverride, svcs)
+	})
+	if err != nil {
+		return fmt.Errorf("sops decryption of %s failed: %w", e.FilenameOverride, err)
 	}
-	if e.ConfigPath != "" {
-		sopsConfigPath = e.ConfigPath
+	*e.Ciphertext = plaintext
+	return nil
+}
+
+// SopsRekeyEffect re-encrypts a SOPS-encrypted document in-place without
+// changing its values. UpdateKeys replaces its master keys with the ones of
+// the creation rule matching FilenameOverride, like `sops updatekeys`.
+// RotateDataKey encrypts it with a new data key, like `sops rotate`.
+type SopsRekeyEffect struct {
+	EffectContext
+	Content          *[]byte       // Reference to encrypted content in memory
+	ConfigPath       string        // Optional path to SOPS configuration file, used by UpdateKeys
+	FilenameOverride string        // Path of the document, used to match creation rules and pick the file format
+	UpdateKeys       bool          // Use the master keys of the matching creation rule
+	RotateDataKey    bool          // Generate a new data key
+	Timeout          time.Duration // Limit for the re-encryption, DefaultSopsTimeout if zero
+}
+
+// NewSopsRotateEffect creates a SopsRekeyEffect rotating the data key of content.
+func NewSopsRotateEffect(content *[]byte, filenameOverride string, envVars map[string]string) *SopsRekeyEffect {
+	return &SopsRekeyEffect{
+		EffectContext: EffectContext{
+			EnvVars: envVars,
+		},
+		Content:          content,
+		FilenameOverride: filenameOverride,
+		RotateDataKey:    true,
 	}
-	if sopsConfigPath != "" {
-		args = append(args, "--config", sopsConfigPath)
+}
+
+// NewSopsUpdateKeysEffect creates a SopsRekeyEffect syncing the master keys of
+// content with the SOPS configuration.
+func NewSopsUpdateKeysEffect(content *[]byte, configPath string, filenameOverride string, envVars map[string]string) *SopsRekeyEffect {
+	return &SopsRekeyEffect{
+		EffectContext: EffectContext{
+			EnvVars: envVars,
+		},
+		Content:          content,
+		ConfigPath:       configPath,
+		FilenameOverride: filenameOverride,
+		UpdateKeys:       true,
 	}
+}
 
-	args = append(args, "encrypt", "--filename-override", e.FilenameOverride)
-	cmd := exec.Command("sops", args...)
+func (e *SopsRekeyEffect) configPath() string {
+	return sopsConfigPath(e.ConfigPath, e.EffectContext.EnvVars)
+}
 
-	// Set up stdin with plaintext
-	cmd.Stdin = bytes.NewReader(*e.Plaintext)
+func (e *SopsRekeyEffect) Apply() error {
+	return e.ApplyContext(context.Background())
+}
 
-	// Set environment variables if provided
-	if e.EffectContext.EnvVars != nil {
-		cmd.Env = os.Environ()
-		for key, value := range e.EffectContext.EnvVars {
-			cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", key, value))
+func (e *SopsRekeyEffect) ApplyContext(ctx context.Context) error {
+	var conf *sopsConfig.Config
+	if e.UpdateKeys {
+		var err error
+		if conf, err = loadCreationRule(e.configPath(), e.FilenameOverride); err != nil {
+			return fmt.Errorf("sops re-encryption of %s failed: %w", e.FilenameOverride, err)
 		}
 	}
-	cwd, err := os.Getwd()
+	ciphertext, err := runSops(ctx, e.Timeout, e.EffectContext.EnvVars, func(svcs []keyservice.KeyServiceClient) ([]byte, error) {
+		return sopsRekey(*e.Content, e.FilenameOverride, conf, e.RotateDataKey, svcs)
+	})
 	if err != nil {
-		return fmt.Errorf("No working directory found, unknown execution environment")
+		return fmt.Errorf("sops re-encryption of %s failed: %w", e.FilenameOverride, err)
 	}
-	cmd.Dir = cwd
-	// Capture stdout for encrypted output
-	var stdoutBuf, stderrBuf bytes.Buffer
-	cmd.Stdout = &stdoutBuf
-	cmd.Stderr = &stderrBuf
+	*e.Content = ciphertext
+	return nil
+}
 
-	// Execute SOPS encryption
-	if err := cmd.Run(); err != nil {
-		if bytes.Contains(stderrBuf.Bytes(), []byte("error loading config: no matching creation rules found")) {
-			log.Default().Printf("No creation rule found in %s for path %s, leaving file unencrypted.", sopsConfigPath, e.FilenameOverride)
-			return nil
-		}
-		return fmt.Errorf("sops encryption failed: %w (stderr: %s)", err, stderrBuf.String())
-	}
+// InvokeParams controls how Invoke applies effects.
+type InvokeParams struct {
+	// Rollback applies the effects as one transaction: the first failure
+	// stops the run and undoes every effect applied so far. When false, all
+	// effects are applied regardless of failures and the errors are joined.
+	Rollback bool
+	// Workers is the maximum number of effects applied concurrently. With
+	// more than one worker, effects are only ordered by the dependencies they
+	// declare (see Dependent). The default of 1 applies them in slice order.
+	Workers int
+	// Report, if set, is filled with every effect and its outcome. Messages
+	// of top-level StdOutIO effects are then only recorded in the report.
+	Report *Report
+}
 
-	*e.Plaintext = stdoutBuf.Bytes()
+func NewDefaultInvokeParams() *InvokeParams {
+	return &InvokeParams{
+		Rollback: true,
+		Workers:  1,
+	}
+}
 
-	return nil
+// Invoke applies effects with the default InvokeParams.
+func Invoke(ctx context.Context, effect ...Effect) error {
+	return InvokeWithParams(ctx, NewDefaultInvokeParams(), effect...)
 }
 
-func Invoke(effect ...Effect) error {
+// InvokeWithParams applies effects, running independent ones concurrently.
+// Once ctx is done no further effects are started, and effects implementing
+// ContextEffect are cancelled.
+func InvokeWithParams(ctx context.Context, params *InvokeParams, effect ...Effect) error {
+	apply := applyTx
+	if !params.Rollback {
+		apply = func(ctx context.Context, e Effect) (Tx, error) {
+			return noTx{}, WithContext(e).ApplyContext(ctx)
+		}
+	}
+
 	var errs []error
-	for _, e := range effect {
-		if err := e.Apply(); err != nil {
-			errs = append(errs, err)
+	var described [][]EffectReport
+	if params.Report != nil {
+		// Effects change buffers in place, describe them beforehand
+		described = describeAll(effect)
+		errs = make([]error, len(effect))
+		for i := range errs {
+			errs[i] = errSkipped
+		}
+		wrapped := apply
+		apply = func(ctx context.Context, e Effect) (Tx, error) {
+			if _, ok := e.(*StdOutIO); ok {
+				return noTx{}, nil
+			}
+			return wrapped(ctx, e)
 		}
 	}
-	if len(errs) != 0 {
-		return errors.Join(errs...)
+	onDone := func(i int, err error) {
+		if errs != nil {
+			errs[i] = err
+		}
 	}
-	return nil
+
+	txs, err := schedule(ctx, params.Workers, !params.Rollback, effect, apply, onDone)
+	rolledBack := false
+	if err != nil && params.Rollback {
+		if rbErr := txs.Rollback(); rbErr != nil {
+			err = errors.Join(err, fmt.Errorf("rollback failed: %w", rbErr))
+		} else {
+			rolledBack = true
+		}
+	} else if err == nil && params.Rollback {
+		err = txs.Commit()
+	}
+
+	if params.Report != nil {
+		for i := range effect {
+			switch {
+			case errs[i] == errSkipped:
+				params.Report.add(described[i], StatusSkipped, nil)
+			case errs[i] != nil:
+				params.Report.add(described[i], StatusFailed, errs[i])
+			case rolledBack:
+				params.Report.add(described[i], StatusRolledBack, nil)
+			default:
+				params.Report.add(described[i], StatusApplied, nil)
+			}
+		}
+		if err != nil {
+			params.Report.Error = err.Error()
+		}
+	}
+	return err
 }
+
+// errSkipped marks effects that were never started in a Report.
+var errSkipped = errors.New("skipped")
@@ -2,10 +2,16 @@ package framework
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
 	"testing"
 
+	"github.com/getsops/sops/v3/decrypt"
 	testutils "github.com/niule-eu/hlcli/test"
 )
 
@@ -63,6 +69,176 @@ func TestFileWriteIO(t *testing.T) {
 			t.Errorf("Expected permissions %v, got %v", expectedMode, info.Mode().Perm())
 		}
 	})
+
+	t.Run("replaces existing file without leaving temp files", func(t *testing.T) {
+		dir := t.TempDir()
+		target := filepath.Join(dir, "existing.txt")
+		if err := os.WriteFile(target, []byte("previous content that is longer"), 0644); err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+
+		if err := NewDefaultFileWriteIO(target, &content).Apply(); err != nil {
+			t.Fatalf("Apply() failed: %v", err)
+		}
+
+		fileContent, err := os.ReadFile(target)
+		if err != nil {
+			t.Fatalf("Failed to read file: %v", err)
+		}
+		if string(fileContent) != string(content) {
+			t.Errorf("Expected content '%s', got '%s'", content, fileContent)
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatalf("Failed to read dir: %v", err)
+		}
+		if len(entries) != 1 {
+			t.Errorf("Expected only the target file in %s, got %d entries", dir, len(entries))
+		}
+	})
+
+	t.Run("keeps the mode of replaced files", func(t *testing.T) {
+		dir := t.TempDir()
+		target := filepath.Join(dir, "secrets.yaml")
+		if err := os.WriteFile(target, []byte("previous"), 0600); err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+
+		if err := NewDefaultFileWriteIO(target, &content).Apply(); err != nil {
+			t.Fatalf("Apply() failed: %v", err)
+		}
+		if mode := fileMode(t, target); mode != 0600 {
+			t.Errorf("Expected %s to keep mode 0600, got %v", target, mode)
+		}
+
+		explicit := NewDefaultFileWriteIO(target, &content)
+		explicit.Permissions = 0640
+		if err := explicit.Apply(); err != nil {
+			t.Fatalf("Apply() failed: %v", err)
+		}
+		if mode := fileMode(t, target); mode != 0640 {
+			t.Errorf("Expected %s to get mode 0640, got %v", target, mode)
+		}
+
+		created := filepath.Join(dir, "created.yaml")
+		if err := NewDefaultFileWriteIO(created, &content).Apply(); err != nil {
+			t.Fatalf("Apply() failed: %v", err)
+		}
+		if mode := fileMode(t, created); mode != DefaultPermissions {
+			t.Errorf("Expected %s to get mode %v, got %v", created, DefaultPermissions, mode)
+		}
+	})
+
+	t.Run("applies the umask to created files", func(t *testing.T) {
+		umask := syscall.Umask(077)
+		defer syscall.Umask(umask)
+		dir := t.TempDir()
+
+		created := filepath.Join(dir, "created.yaml")
+		if err := NewDefaultFileWriteIO(created, &content).Apply(); err != nil {
+			t.Fatalf("Apply() failed: %v", err)
+		}
+		if mode := fileMode(t, created); mode != 0600 {
+			t.Errorf("Expected %s to get mode 0600, got %v", created, mode)
+		}
+
+		explicit := NewDefaultFileWriteIO(filepath.Join(dir, "explicit.yaml"), &content)
+		explicit.Permissions = 0644
+		if err := explicit.Apply(); err != nil {
+			t.Fatalf("Apply() failed: %v", err)
+		}
+		if mode := fileMode(t, explicit.Path); mode != 0600 {
+			t.Errorf("Expected %s to get mode 0600, got %v", explicit.Path, mode)
+		}
+
+		existing := filepath.Join(dir, "existing.yaml")
+		if err := os.WriteFile(existing, []byte("previous"), 0600); err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+		if err := os.Chmod(existing, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := NewDefaultFileWriteIO(existing, &content).Apply(); err != nil {
+			t.Fatalf("Apply() failed: %v", err)
+		}
+		if mode := fileMode(t, existing); mode != 0644 {
+			t.Errorf("Expected %s to keep mode 0644, got %v", existing, mode)
+		}
+	})
+
+	t.Run("writes through symlinks", func(t *testing.T) {
+		dir := t.TempDir()
+		target := filepath.Join(dir, "target.txt")
+		link := filepath.Join(dir, "link.txt")
+		if err := os.WriteFile(target, []byte("old"), 0644); err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatalf("Failed to create symlink: %v", err)
+		}
+
+		if err := NewDefaultFileWriteIO(link, &content).Apply(); err != nil {
+			t.Fatalf("Apply() failed: %v", err)
+		}
+
+		if info, err := os.Lstat(link); err != nil || info.Mode()&os.ModeSymlink == 0 {
+			t.Errorf("Expected %s to remain a symlink", link)
+		}
+		fileContent, err := os.ReadFile(target)
+		if err != nil {
+			t.Fatalf("Failed to read file: %v", err)
+		}
+		if string(fileContent) != string(content) {
+			t.Errorf("Expected content '%s', got '%s'", content, fileContent)
+		}
+	})
+
+	t.Run("writes special files directly", func(t *testing.T) {
+		if err := NewDefaultFileWriteIO(os.DevNull, &content).Apply(); err != nil {
+			t.Fatalf("Apply() failed for %s: %v", os.DevNull, err)
+		}
+	})
+
+	t.Run("writes standard streams in place", func(t *testing.T) {
+		f, err := os.CreateTemp(t.TempDir(), "stdout-*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		stdout := os.Stdout
+		os.Stdout = f
+		defer func() { os.Stdout = stdout }()
+		if _, err := f.WriteString("header\n"); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := NewDefaultFileWriteIO("/dev/stdout", &content).Apply(); err != nil {
+			t.Fatalf("Apply() failed for /dev/stdout: %v", err)
+		}
+		written, err := os.ReadFile(f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := "header\n" + string(content); string(written) != expected {
+			t.Errorf("Expected %q, got %q", expected, written)
+		}
+	})
+
+	t.Run("surfaces errors for missing directories", func(t *testing.T) {
+		target := filepath.Join(t.TempDir(), "missing", "file.txt")
+		if err := NewDefaultFileWriteIO(target, &content).Apply(); err == nil {
+			t.Error("Expected error for missing directory, got nil")
+		}
+	})
+}
+
+func fileMode(t *testing.T, path string) os.FileMode {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Failed to stat file: %v", err)
+	}
+	return info.Mode().Perm()
 }
 
 func TestCompoundEffect(t *testing.T) {
@@ -142,6 +318,37 @@ func TestStdOutIO(t *testing.T) {
 	})
 }
 
+func TestContextCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	t.Run("does not start effects once cancelled", func(t *testing.T) {
+		target := filepath.Join(t.TempDir(), "cancelled.txt")
+		content := []byte("content")
+
+		err := Invoke(ctx, NewDefaultFileWriteIO(target, &content))
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected context.Canceled, got %v", err)
+		}
+		if _, err := os.Stat(target); !os.IsNotExist(err) {
+			t.Errorf("Expected %s not to be written", target)
+		}
+	})
+
+	t.Run("aborts SOPS encryption", func(t *testing.T) {
+		content := []byte(`{"data": "secret"}`)
+		effect := NewDefaultSopsEncryptEffect(&content)
+
+		err := effect.ApplyContext(ctx)
+		if err == nil {
+			t.Fatal("Expected error from cancelled context, got nil")
+		}
+		if string(content) != `{"data": "secret"}` {
+			t.Errorf("Expected original content preserved, got: %s", content)
+		}
+	})
+}
+
 func TestSopsEncryptEffect(t *testing.T) {
 
 	execEnv := testutils.NewSopsExecEnv(t)
@@ -344,4 +551,256 @@ func TestSopsEncryptEffect(t *testing.T) {
 
 		t.Logf("Successfully encrypted and wrote file (%d bytes)", len(fileContent))
 	})
+	t.Run("encrypted content decrypts with the age key", func(t *testing.T) {
+		content := []byte(`{"data": "round-trip secret"}`)
+		effect := NewSopsEncryptEffect(&content, "", execEnv.GetJsonPath(), execEnv.EnvVars)
+		if err := effect.Apply(); err != nil {
+			t.Fatalf("Encryption failed: %v", err)
+		}
+
+		for key, value := range execEnv.EnvVars {
+			t.Setenv(key, value)
+		}
+		plaintext, err := decrypt.Data(content, "json")
+		if err != nil {
+			t.Fatalf("Decryption failed: %v", err)
+		}
+		if !bytes.Contains(plaintext, []byte("round-trip secret")) {
+			t.Errorf("Expected decrypted content to contain the secret, got: %s", plaintext)
+		}
+	})
+
+	t.Run("leaves content unencrypted without a matching creation rule", func(t *testing.T) {
+		configPath := filepath.Join(t.TempDir(), ".sops.yaml")
+		config := []byte("creation_rules:\n  - path_regex: '\\.never$'\n    age: 'age1unused'\n")
+		if err := os.WriteFile(configPath, config, 0600); err != nil {
+			t.Fatal(err)
+		}
+		content := []byte(`{"data": "secret"}`)
+		effect := NewSopsEncryptEffect(&content, configPath, execEnv.GetJsonPath(), nil)
+
+		if err := effect.Apply(); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		if string(content) != `{"data": "secret"}` {
+			t.Errorf("Expected content left unencrypted, got: %s", content)
+		}
+	})
+}
+
+func TestSopsEncryptEffectRule(t *testing.T) {
+	execEnv := testutils.NewSopsExecEnv(t)
+
+	decrypt := func(t *testing.T, content []byte, path string) string {
+		t.Helper()
+		if err := NewSopsDecryptEffect(&content, path, execEnv.EnvVars).Apply(); err != nil {
+			t.Fatalf("Decryption failed: %v", err)
+		}
+		return string(content)
+	}
+
+	t.Run("encrypts with explicit key groups without a creation rule", func(t *testing.T) {
+		configPath := filepath.Join(t.TempDir(), ".sops.yaml")
+		config := []byte("creation_rules:\n  - path_regex: '\\.never$'\n    age: 'age1unused'\n")
+		if err := os.WriteFile(configPath, config, 0600); err != nil {
+			t.Fatal(err)
+		}
+		path := execEnv.GetYamlPath()
+		content := []byte("data: secret\n")
+		effect := NewSopsEncryptEffect(&content, configPath, path, execEnv.EnvVars)
+		effect.Rule = &SopsRule{KeyGroups: []SopsKeyGroup{{Age: []string{execEnv.AgeRecipient}}}}
+
+		if err := effect.Apply(); err != nil {
+			t.Fatalf("Encryption failed: %v", err)
+		}
+		if bytes.Contains(content, []byte("secret")) {
+			t.Errorf("Expected encrypted content, got: %s", content)
+		}
+		if got := decrypt(t, content, path); got != "data: secret\n" {
+			t.Errorf("Expected decrypted content, got: %s", got)
+		}
+	})
+
+	t.Run("overrides the encrypted keys of the creation rule", func(t *testing.T) {
+		path := execEnv.GetPartiallyEncryptedYamlPath()
+		content := []byte("data: visible\nplain: hidden\n")
+		effect := NewSopsEncryptEffect(&content, "", path, execEnv.EnvVars)
+		effect.Rule = &SopsRule{EncryptedRegex: "^plain$"}
+
+		if err := effect.Apply(); err != nil {
+			t.Fatalf("Encryption failed: %v", err)
+		}
+		if !bytes.Contains(content, []byte("data: visible")) || bytes.Contains(content, []byte("hidden")) {
+			t.Errorf("Expected only plain encrypted, got: %s", content)
+		}
+	})
+
+	t.Run("fails without a matching creation rule", func(t *testing.T) {
+		configPath := filepath.Join(t.TempDir(), ".sops.yaml")
+		config := []byte("creation_rules:\n  - path_regex: '\\.never$'\n    age: 'age1unused'\n")
+		if err := os.WriteFile(configPath, config, 0600); err != nil {
+			t.Fatal(err)
+		}
+		content := []byte("data: secret\n")
+		effect := NewSopsEncryptEffect(&content, configPath, execEnv.GetYamlPath(), nil)
+		effect.Rule = &SopsRule{EncryptedRegex: "^data$"}
+
+		var noRule *NoMatchingCreationRuleError
+		if err := effect.Apply(); !errors.As(err, &noRule) {
+			t.Fatalf("Expected NoMatchingCreationRuleError, got: %v", err)
+		}
+		if string(content) != "data: secret\n" {
+			t.Errorf("Expected content preserved, got: %s", content)
+		}
+	})
+
+	t.Run("rejects several key selectors", func(t *testing.T) {
+		content := []byte("data: secret\n")
+		effect := NewSopsEncryptEffect(&content, "", execEnv.GetYamlPath(), execEnv.EnvVars)
+		effect.Rule = &SopsRule{EncryptedRegex: "^data$", UnencryptedSuffix: "_plain"}
+
+		if err := effect.Apply(); err == nil {
+			t.Fatal("Expected error, got nil")
+		}
+	})
+}
+
+func TestSopsDecryptEffect(t *testing.T) {
+	execEnv := testutils.NewSopsExecEnv(t)
+
+	encrypt := func(t *testing.T, path string, plaintext string) []byte {
+		t.Helper()
+		content := []byte(plaintext)
+		if err := NewSopsEncryptEffect(&content, "", path, execEnv.EnvVars).Apply(); err != nil {
+			t.Fatalf("Encryption failed: %v", err)
+		}
+		return content
+	}
+
+	t.Run("decrypts content in place", func(t *testing.T) {
+		path := execEnv.GetYamlPath()
+		content := encrypt(t, path, "data: secret-value\n")
+
+		if err := NewSopsDecryptEffect(&content, path, execEnv.EnvVars).Apply(); err != nil {
+			t.Fatalf("Decryption failed: %v", err)
+		}
+		if string(content) != "data: secret-value\n" {
+			t.Errorf("Expected decrypted content, got: %s", content)
+		}
+	})
+
+	t.Run("preserves ciphertext without the key", func(t *testing.T) {
+		path := execEnv.GetYamlPath()
+		content := encrypt(t, path, "data: secret-value\n")
+		ciphertext := string(content)
+
+		err := NewSopsDecryptEffect(&content, path, map[string]string{"SOPS_AGE_KEY": ""}).Apply()
+		if err == nil {
+			t.Fatal("Expected error without the age key, got nil")
+		}
+		if string(content) != ciphertext {
+			t.Errorf("Expected ciphertext preserved on error")
+		}
+	})
+
+	t.Run("keeps credentials of concurrent decryptions apart", func(t *testing.T) {
+		otherEnv := testutils.NewSopsExecEnv(t)
+		path := execEnv.GetYamlPath()
+		content := []byte("data: other-value\n")
+		if err := NewSopsEncryptEffect(&content, "", path, otherEnv.EnvVars).Apply(); err != nil {
+			t.Fatalf("Encryption failed: %v", err)
+		}
+		ciphertexts := map[*testutils.SopsExecEnvironment][]byte{
+			execEnv:  encrypt(t, path, "data: secret-value\n"),
+			otherEnv: content,
+		}
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 20)
+		for i := range 20 {
+			env := execEnv
+			if i%2 == 1 {
+				env = otherEnv
+			}
+			wg.Go(func() {
+				content := bytes.Clone(ciphertexts[env])
+				errs <- NewSopsDecryptEffect(&content, path, env.EnvVars).Apply()
+			})
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				t.Errorf("Decryption failed: %v", err)
+			}
+		}
+		if _, ok := os.LookupEnv("SOPS_AGE_KEY"); ok {
+			t.Error("Expected the process environment to be left alone")
+		}
+	})
+
+	t.Run("rejects unsupported environment variables", func(t *testing.T) {
+		content := encrypt(t, execEnv.GetYamlPath(), "data: secret-value\n")
+		var unsupported *UnsupportedSopsEnvError
+		err := NewSopsDecryptEffect(&content, "secrets.yaml", map[string]string{"LD_PRELOAD": "x.so"}).Apply()
+		if !errors.As(err, &unsupported) || unsupported.Name != "LD_PRELOAD" {
+			t.Errorf("Expected UnsupportedSopsEnvError, got %v", err)
+		}
+	})
+
+	t.Run("re-encrypts with the keys of the original", func(t *testing.T) {
+		path := execEnv.GetPartiallyEncryptedYamlPath()
+		original := encrypt(t, path, "data: old\nplain: value\n")
+
+		content := []byte("data: new\nplain: value\n")
+		effect := NewSopsEncryptEffect(&content, "", path, execEnv.EnvVars)
+		effect.Original = original
+		if err := effect.Apply(); err != nil {
+			t.Fatalf("Re-encryption failed: %v", err)
+		}
+		if bytes.Contains(content, []byte("data: new")) || !bytes.Contains(content, []byte("plain: value")) {
+			t.Errorf("Expected only data to be encrypted, got: %s", content)
+		}
+		if err := NewSopsDecryptEffect(&content, path, execEnv.EnvVars).Apply(); err != nil {
+			t.Fatalf("Decryption failed: %v", err)
+		}
+		if string(content) != "data: new\nplain: value\n" {
+			t.Errorf("Expected edited content, got: %s", content)
+		}
+	})
+
+	t.Run("rotates the data key", func(t *testing.T) {
+		path := execEnv.GetYamlPath()
+		content := encrypt(t, path, "data: secret-value\n")
+		before := string(content)
+
+		if err := NewSopsRotateEffect(&content, path, execEnv.EnvVars).Apply(); err != nil {
+			t.Fatalf("Rotation failed: %v", err)
+		}
+		if string(content) == before {
+			t.Error("Expected ciphertext to change")
+		}
+		if err := NewSopsDecryptEffect(&content, path, execEnv.EnvVars).Apply(); err != nil {
+			t.Fatalf("Decryption failed: %v", err)
+		}
+		if string(content) != "data: secret-value\n" {
+			t.Errorf("Expected values unchanged, got: %s", content)
+		}
+	})
+
+	t.Run("updates keys from the creation rule", func(t *testing.T) {
+		path := execEnv.GetYamlPath()
+		content := encrypt(t, path, "data: secret-value\n")
+
+		effect := NewSopsUpdateKeysEffect(&content, "", path, execEnv.EnvVars)
+		if err := effect.Apply(); err != nil {
+			t.Fatalf("Updating keys failed: %v", err)
+		}
+		if err := NewSopsDecryptEffect(&content, path, execEnv.EnvVars).Apply(); err != nil {
+			t.Fatalf("Decryption failed: %v", err)
+		}
+		if string(content) != "data: secret-value\n" {
+			t.Errorf("Expected values unchanged, got: %s", content)
+		}
+	})
 }
@@ -0,0 +1,162 @@
+package framework
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ActionKind classifies what a planned Action would do.
+type ActionKind string
+
+const (
+	ActionWrite   ActionKind = "write"
+	ActionDelete  ActionKind = "delete"
+	ActionEncrypt ActionKind = "encrypt"
+	ActionDecrypt ActionKind = "decrypt"
+	ActionPrint   ActionKind = "print"
+	ActionUnknown ActionKind = "unknown"
+)
+
+// Action describes a single side effect an Effect would perform when applied.
+type Action struct {
+	Kind   ActionKind
+	Path   string // Target of the action, empty when there is none
+	Size   int    // Size in bytes of the content involved, if any
+	Detail string // Free-form, human readable context
+}
+
+func (a Action) String() string {
+	s := fmt.Sprintf("%-8s", a.Kind)
+	if a.Path != "" {
+		s += " " + a.Path
+	}
+	if a.Kind == ActionWrite || a.Kind == ActionEncrypt || a.Kind == ActionDecrypt {
+		s += fmt.Sprintf(" (%d bytes)", a.Size)
+	}
+	if a.Detail != "" {
+		s += " " + a.Detail
+	}
+	return s
+}
+
+// Planner is implemented by effects that can describe what they would do
+// without doing it.
+type Planner interface {
+	Plan() []Action
+}
+
+func (fw FileWriteIO) Plan() []Action {
+	size := 0
+	if fw.Content != nil {
+		size = len(*fw.Content)
+	}
+	perm, _ := fw.permissions()
+	return []Action{{
+		Kind:   ActionWrite,
+		Path:   fw.Path,
+		Size:   size,
+		Detail: fmt.Sprintf("[%v]", perm),
+	}}
+}
+
+func (fdio *FileDeleteIO) Plan() []Action {
+	return []Action{{Kind: ActionDelete, Path: fdio.Path}}
+}
+
+func (n *NoOp) Plan() []Action {
+	return nil
+}
+
+func (sdtoutio *StdOutIO) Plan() []Action {
+	return []Action{{Kind: ActionPrint, Detail: sdtoutio.Message}}
+}
+
+func (fw CompoundEffect) Plan() []Action {
+	return Plan(fw.Effects...)
+}
+
+func (e *SopsEncryptEffect) Plan() []Action {
+	detail := "(no .sops.yaml found)"
+	if e.Original != nil {
+		detail = "(keys of the original)"
+	} else if e.Rule != nil && len(e.Rule.KeyGroups) > 0 {
+		detail = fmt.Sprintf("(%d explicit key group(s))", len(e.Rule.KeyGroups))
+	} else if p := e.configPath(); p != "" {
+		detail = "(config " + p + ")"
+	}
+	return []Action{{
+		Kind:   ActionEncrypt,
+		Path:   e.FilenameOverride,
+		Size:   len(*e.Plaintext),
+		Detail: detail,
+	}}
+}
+
+func (e *SopsDecryptEffect) Plan() []Action {
+	return []Action{{
+		Kind: ActionDecrypt,
+		Path: e.FilenameOverride,
+		Size: len(*e.Ciphertext),
+	}}
+}
+
+func (e *SopsRekeyEffect) Plan() []Action {
+	var changes []string
+	if e.UpdateKeys {
+		p := e.configPath()
+		if p == "" {
+			p = "no .sops.yaml found"
+		}
+		changes = append(changes, "update keys from "+p)
+	}
+	if e.RotateDataKey {
+		changes = append(changes, "rotate data key")
+	}
+	return []Action{{
+		Kind:   ActionEncrypt,
+		Path:   e.FilenameOverride,
+		Size:   len(*e.Content),
+		Detail: "(" + strings.Join(changes, ", ") + ")",
+	}}
+}
+
+// Plan collects the actions the given effects would perform, in execution
+// order, without applying any of them. Effects that do not implement Planner
+// are reported as ActionUnknown.
+func Plan(effect ...Effect) []Action {
+	var actions []Action
+	for _, e := range effect {
+		if p, ok := e.(Planner); ok {
+			actions = append(actions, p.Plan()...)
+		} else {
+			actions = append(actions, Action{Kind: ActionUnknown, Detail: fmt.Sprintf("%T", e)})
+		}
+	}
+	return actions
+}
+
+// WritesStdout tells whether any of the actions writes to standard output.
+func WritesStdout(actions []Action) bool {
+	for _, a := range actions {
+		if a.Kind == ActionWrite && streamFile(a.Path) == os.Stdout {
+			return true
+		}
+	}
+	return false
+}
+
+// WritePlan writes one line per action to w.
+func WritePlan(w io.Writer, actions []Action) error {
+	if len(actions) == 0 {
+		_, err := fmt.Fprintln(w, "nothing to do")
+		return err
+	}
+	for _, a := range actions {
+		if _, err := fmt.Fprintln(w, a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
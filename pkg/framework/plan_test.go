@@ -0,0 +1,72 @@
+package framework
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPlan(t *testing.T) {
+	content := []byte("planned content")
+
+	t.Run("describes effects without applying them", func(t *testing.T) {
+		target := "test_plan_output.txt"
+		defer os.Remove(target)
+
+		effects := []Effect{
+			CompoundEffect{
+				Effects: []Effect{
+					NewSopsEncryptEffect(&content, "/tmp/.sops.yaml", target, nil),
+					NewDefaultFileWriteIO(target, &content),
+				},
+			},
+			&FileDeleteIO{Path: "stale.txt", Op: os.Remove},
+			&NoOp{},
+		}
+		actions := Plan(effects...)
+
+		if len(actions) != 3 {
+			t.Fatalf("Expected 3 actions, got %d: %v", len(actions), actions)
+		}
+		expectedKinds := []ActionKind{ActionEncrypt, ActionWrite, ActionDelete}
+		for i, kind := range expectedKinds {
+			if actions[i].Kind != kind {
+				t.Errorf("Expected action %d to be %s, got %s", i, kind, actions[i].Kind)
+			}
+		}
+		if actions[1].Size != len(content) {
+			t.Errorf("Expected write size %d, got %d", len(content), actions[1].Size)
+		}
+		if _, err := os.Stat(target); !os.IsNotExist(err) {
+			t.Errorf("Expected %s not to be written by Plan", target)
+		}
+	})
+
+	t.Run("writes one line per action", func(t *testing.T) {
+		var out bytes.Buffer
+		err := WritePlan(&out, Plan(NewDefaultFileWriteIO("a.txt", &content), &FileDeleteIO{Path: "b.txt"}))
+		if err != nil {
+			t.Fatalf("WritePlan() failed: %v", err)
+		}
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		if len(lines) != 2 {
+			t.Fatalf("Expected 2 lines, got %d: %q", len(lines), out.String())
+		}
+		if !strings.HasPrefix(lines[0], "write") || !strings.Contains(lines[0], "a.txt") {
+			t.Errorf("Unexpected write line: %q", lines[0])
+		}
+		if !strings.HasPrefix(lines[1], "delete") || !strings.Contains(lines[1], "b.txt") {
+			t.Errorf("Unexpected delete line: %q", lines[1])
+		}
+	})
+
+	t.Run("tells writes to stdout", func(t *testing.T) {
+		if WritesStdout(Plan(NewDefaultFileWriteIO("a.txt", &content), NewStdOutIO("done"))) {
+			t.Error("Expected no write to stdout")
+		}
+		if !WritesStdout(Plan(CompoundEffect{Effects: []Effect{NewDefaultFileWriteIO("/dev/stdout", &content)}})) {
+			t.Error("Expected a write to stdout")
+		}
+	})
+}
@@ -0,0 +1,199 @@
+package framework
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"reflect"
+
+	"github.com/niule-eu/hlcli/pkg/redact"
+)
+
+// EffectStatus is the outcome of an effect in a Report.
+type EffectStatus string
+
+const (
+	StatusPlanned    EffectStatus = "planned"
+	StatusApplied    EffectStatus = "applied"
+	StatusFailed     EffectStatus = "failed"
+	StatusSkipped    EffectStatus = "skipped"
+	StatusRolledBack EffectStatus = "rolled back"
+)
+
+// EffectReport describes a single effect of a run. Compound effects are
+// reported as their individual effects, sharing the status of the compound.
+// Effects are described as they were before being applied. Content that a
+// SOPS effect transforms in place has no SHA256, as it is either plaintext
+// or not yet the content written. Content is only reported as encrypted if a
+// creation rule matches its path, otherwise it is written as plaintext.
+type EffectReport struct {
+	Type      string       `json:"type"`
+	Path      string       `json:"path,omitempty"`
+	Size      int          `json:"size,omitempty"`
+	SHA256    string       `json:"sha256,omitempty"`
+	Encrypted bool         `json:"encrypted"`
+	Decrypted bool         `json:"decrypted,omitempty"`
+	Message   string       `json:"message,omitempty"`
+	Status    EffectStatus `json:"status"`
+	Error     string       `json:"error,omitempty"`
+}
+
+// Report is a machine-readable description of a run, suitable for CI.
+type Report struct {
+	Effects []EffectReport `json:"effects"`
+	Error   string         `json:"error,omitempty"`
+}
+
+// PlanReport describes the given effects without applying them.
+func PlanReport(effect ...Effect) *Report {
+	r := &Report{Effects: []EffectReport{}}
+	for _, described := range describeAll(effect) {
+		r.add(described, StatusPlanned, nil)
+	}
+	return r
+}
+
+// Redact masks the values known to r in every message and error of the
+// report.
+func (r *Report) Redact(rd *redact.Redactor) {
+	for i := range r.Effects {
+		r.Effects[i].Message = rd.String(r.Effects[i].Message)
+		r.Effects[i].Error = rd.String(r.Effects[i].Error)
+	}
+	r.Error = rd.String(r.Error)
+}
+
+// Write writes the report to w as indented JSON.
+func (r *Report) Write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// add records the effect reports of one effect, described by describeAll.
+func (r *Report) add(described []EffectReport, status EffectStatus, err error) {
+	for _, er := range described {
+		er.Status = status
+		if err != nil {
+			er.Error = err.Error()
+		}
+		r.Effects = append(r.Effects, er)
+	}
+}
+
+// sopsTransform is how a SOPS effect changes a buffer in place.
+type sopsTransform int
+
+const (
+	sopsEncrypts sopsTransform = iota + 1
+	sopsDecrypts
+)
+
+// describeAll describes each effect with its current content, so it must
+// run before the effects are applied.
+func describeAll(effects []Effect) [][]EffectReport {
+	transformed := map[*[]byte]sopsTransform{}
+	for _, e := range effects {
+		findSopsBuffers(e, transformed)
+	}
+	described := make([][]EffectReport, len(effects))
+	for i, e := range effects {
+		described[i] = describe(e, transformed)
+	}
+	return described
+}
+
+// findSopsBuffers records the buffers that the SOPS effects of e transform.
+func findSopsBuffers(e Effect, transformed map[*[]byte]sopsTransform) {
+	switch e := e.(type) {
+	case CompoundEffect:
+		for _, inner := range e.Effects {
+			findSopsBuffers(inner, transformed)
+		}
+	case *DependentEffect:
+		findSopsBuffers(e.Effect, transformed)
+	case *SopsEncryptEffect:
+		if e.encrypts() {
+			transformed[e.Plaintext] = sopsEncrypts
+		}
+	case *SopsRekeyEffect:
+		transformed[e.Content] = sopsEncrypts
+	case *SopsDecryptEffect:
+		transformed[e.Ciphertext] = sopsDecrypts
+	}
+}
+
+// describe reports e, or the effects it is made of. Content written from a
+// buffer that a SOPS effect encrypts or decrypts is marked as such, and only
+// content no SOPS effect transforms is hashed.
+func describe(e Effect, transformed map[*[]byte]sopsTransform) []EffectReport {
+	switch e := e.(type) {
+	case CompoundEffect:
+		var out []EffectReport
+		for _, inner := range e.Effects {
+			out = append(out, describe(inner, transformed)...)
+		}
+		return out
+	case *DependentEffect:
+		return describe(e.Effect, transformed)
+	case *FileWriteIO:
+		return describe(*e, transformed)
+	case FileWriteIO:
+		er := EffectReport{
+			Type:      effectType(e),
+			Path:      e.Path,
+			Encrypted: transformed[e.Content] == sopsEncrypts,
+			Decrypted: transformed[e.Content] == sopsDecrypts,
+		}
+		if e.Content != nil {
+			er.Size = len(*e.Content)
+			if _, ok := transformed[e.Content]; !ok {
+				er.SHA256 = contentHash(*e.Content)
+			}
+		}
+		return []EffectReport{er}
+	case *FileDeleteIO:
+		return []EffectReport{{Type: effectType(e), Path: e.Path}}
+	case *SopsEncryptEffect:
+		return []EffectReport{{
+			Type:      effectType(e),
+			Path:      e.FilenameOverride,
+			Size:      len(*e.Plaintext),
+			Encrypted: transformed[e.Plaintext] == sopsEncrypts,
+		}}
+	case *SopsDecryptEffect:
+		return []EffectReport{{
+			Type:      effectType(e),
+			Path:      e.FilenameOverride,
+			Size:      len(*e.Ciphertext),
+			SHA256:    contentHash(*e.Ciphertext),
+			Decrypted: true,
+		}}
+	case *SopsRekeyEffect:
+		return []EffectReport{{
+			Type:      effectType(e),
+			Path:      e.FilenameOverride,
+			Size:      len(*e.Content),
+			SHA256:    contentHash(*e.Content),
+			Encrypted: true,
+		}}
+	case *StdOutIO:
+		return []EffectReport{{Type: effectType(e), Message: e.Message}}
+	default:
+		return []EffectReport{{Type: effectType(e)}}
+	}
+}
+
+func effectType(e Effect) string {
+	t := reflect.TypeOf(e)
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t.Name()
+}
+
+func contentHash(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,151 @@
+package framework
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReport(t *testing.T) {
+	content := []byte("reported content")
+
+	t.Run("describes planned effects", func(t *testing.T) {
+		target := "report.yaml"
+		report := PlanReport(
+			CompoundEffect{
+				Effects: []Effect{
+					NewSopsEncryptEffect(&content, "", target, nil),
+					NewDefaultFileWriteIO(target, &content),
+				},
+			},
+			NewStdOutIO("hello"),
+		)
+
+		if len(report.Effects) != 3 {
+			t.Fatalf("Expected 3 effects, got %d", len(report.Effects))
+		}
+		write := report.Effects[1]
+		if write.Type != "FileWriteIO" || write.Path != target || !write.Encrypted {
+			t.Errorf("Unexpected write report: %+v", write)
+		}
+		if write.Size != len(content) || write.SHA256 != "" {
+			t.Errorf("Expected size and no hash of the plaintext, got %+v", write)
+		}
+		if report.Effects[0].SHA256 != "" {
+			t.Errorf("Expected no hash of the plaintext, got %+v", report.Effects[0])
+		}
+		if report.Effects[2].Message != "hello" || report.Effects[2].Status != StatusPlanned {
+			t.Errorf("Unexpected stdout report: %+v", report.Effects[2])
+		}
+
+		var out bytes.Buffer
+		if err := report.Write(&out); err != nil {
+			t.Fatalf("Write() failed: %v", err)
+		}
+		var decoded Report
+		if err := json.Unmarshal(out.Bytes(), &decoded); err != nil {
+			t.Fatalf("Report is not valid JSON: %v\n%s", err, out.String())
+		}
+	})
+
+	t.Run("reports content no creation rule matches as plaintext", func(t *testing.T) {
+		configPath := filepath.Join(t.TempDir(), ".sops.yaml")
+		config := []byte("creation_rules:\n  - path_regex: '\\.never$'\n    age: 'age1unused'\n")
+		if err := os.WriteFile(configPath, config, 0600); err != nil {
+			t.Fatal(err)
+		}
+		target := "report.yaml"
+		report := PlanReport(CompoundEffect{
+			Effects: []Effect{
+				NewSopsEncryptEffect(&content, configPath, target, nil),
+				NewDefaultFileWriteIO(target, &content),
+			},
+		})
+
+		if len(report.Effects) != 2 {
+			t.Fatalf("Expected 2 effects, got %d", len(report.Effects))
+		}
+		if encrypt := report.Effects[0]; encrypt.Encrypted {
+			t.Errorf("Expected the encryption to be reported as skipped, got %+v", encrypt)
+		}
+		if write := report.Effects[1]; write.Encrypted || write.SHA256 != contentHash(content) {
+			t.Errorf("Expected the plaintext to be reported as written, got %+v", write)
+		}
+	})
+
+	t.Run("records the outcome of each effect", func(t *testing.T) {
+		dir := t.TempDir()
+		written := filepath.Join(dir, "written.txt")
+		report := &Report{}
+		params := &InvokeParams{Rollback: true, Workers: 1, Report: report}
+
+		err := InvokeWithParams(context.Background(), params,
+			NewDefaultFileWriteIO(written, &content),
+			NewDefaultFileWriteIO(filepath.Join(dir, "missing", "file.txt"), &content),
+			NewDefaultFileWriteIO(filepath.Join(dir, "never.txt"), &content),
+		)
+		if err == nil {
+			t.Fatal("Expected error from missing directory, got nil")
+		}
+
+		expected := []EffectStatus{StatusRolledBack, StatusFailed, StatusSkipped}
+		if len(report.Effects) != len(expected) {
+			t.Fatalf("Expected %d effects, got %d", len(expected), len(report.Effects))
+		}
+		for i, status := range expected {
+			if report.Effects[i].Status != status {
+				t.Errorf("Expected effect %d to be %s, got %s", i, status, report.Effects[i].Status)
+			}
+		}
+		if report.Effects[1].Error == "" || report.Error == "" {
+			t.Error("Expected the failure to be reported")
+		}
+		if _, err := os.Stat(written); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be rolled back", written)
+		}
+	})
+
+	t.Run("hashes content before it is applied", func(t *testing.T) {
+		dir := t.TempDir()
+		plain := filepath.Join(dir, "plain.txt")
+		ciphertext := []byte("ENC[...]")
+		decrypting := &SopsDecryptEffect{Ciphertext: &ciphertext, FilenameOverride: "secrets.yaml"}
+		original := []byte("original content")
+		changing := &bufferEffect{buf: &original, next: []byte("changed")}
+		report := &Report{}
+		params := &InvokeParams{Rollback: false, Workers: 1, Report: report}
+
+		InvokeWithParams(context.Background(), params,
+			CompoundEffect{Effects: []Effect{decrypting, NewDefaultFileWriteIO(filepath.Join(dir, "secrets.yaml"), &ciphertext)}},
+			changing,
+			NewDefaultFileWriteIO(plain, &original),
+		)
+
+		if len(report.Effects) != 4 {
+			t.Fatalf("Expected 4 effects, got %d", len(report.Effects))
+		}
+		if decrypt := report.Effects[0]; decrypt.SHA256 != contentHash([]byte("ENC[...]")) || !decrypt.Decrypted {
+			t.Errorf("Expected the hash of the ciphertext, got %+v", decrypt)
+		}
+		if write := report.Effects[1]; write.SHA256 != "" || !write.Decrypted {
+			t.Errorf("Expected decrypted content without hash, got %+v", write)
+		}
+		if write := report.Effects[3]; write.SHA256 != contentHash([]byte("original content")) || write.Status != StatusApplied {
+			t.Errorf("Expected the hash of the content before it changed, got %+v", write)
+		}
+	})
+}
+
+// bufferEffect replaces the content of buf with next.
+type bufferEffect struct {
+	buf  *[]byte
+	next []byte
+}
+
+func (b *bufferEffect) Apply() error {
+	*b.buf = b.next
+	return nil
+}
@@ -0,0 +1,217 @@
+package framework
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+)
+
+// Dependent is implemented by effects that must not start before other
+// effects of the same run have been applied successfully.
+type Dependent interface {
+	DependsOn() []Effect
+}
+
+// DependentEffect wraps an Effect with the effects it depends on. Effects
+// without dependencies between them may be applied concurrently by Invoke.
+// Dependencies are matched by identity, so they should be pointers to effects
+// that are part of the same Invoke call.
+type DependentEffect struct {
+	Effect
+	Dependencies []Effect
+}
+
+// After declares that effect depends on deps.
+func After(effect Effect, deps ...Effect) *DependentEffect {
+	return &DependentEffect{
+		Effect:       effect,
+		Dependencies: deps,
+	}
+}
+
+func (d *DependentEffect) DependsOn() []Effect {
+	return d.Dependencies
+}
+
+func (d *DependentEffect) ApplyContext(ctx context.Context) error {
+	return WithContext(d.Effect).ApplyContext(ctx)
+}
+
+func (d *DependentEffect) ApplyTx(ctx context.Context) (Tx, error) {
+	return applyTx(ctx, d.Effect)
+}
+
+func (d *DependentEffect) Plan() []Action {
+	return Plan(d.Effect)
+}
+
+func (d *DependentEffect) Diff() ([]FileDiff, error) {
+	return Diff(d.Effect)
+}
+
+// CyclicDependencyError is returned when effects depend on each other.
+type CyclicDependencyError struct {
+	Effects []Effect
+}
+
+func (e *CyclicDependencyError) Error() string {
+	return fmt.Sprintf("cyclic dependency between %d effects", len(e.Effects))
+}
+
+// sameEffect reports whether a and b are the same effect. Effects with
+// uncomparable dynamic types (e.g. CompoundEffect values) never match.
+func sameEffect(a, b Effect) bool {
+	if reflect.TypeOf(a) != reflect.TypeOf(b) || !reflect.TypeOf(a).Comparable() {
+		return false
+	}
+	return a == b
+}
+
+// dependencyGraph resolves the declared dependencies of effects to indexes.
+// It returns, for every effect, the effects depending on it and the number
+// of effects it depends on.
+func dependencyGraph(effects []Effect) ([][]int, []int, error) {
+	dependents := make([][]int, len(effects))
+	indegree := make([]int, len(effects))
+	for i, e := range effects {
+		d, ok := e.(Dependent)
+		if !ok {
+			continue
+		}
+		for _, dep := range d.DependsOn() {
+			j := slices.IndexFunc(effects, func(other Effect) bool { return sameEffect(other, dep) })
+			if j == -1 {
+				return nil, nil, fmt.Errorf("%T depends on %T, which is not part of the run", e, dep)
+			}
+			dependents[j] = append(dependents[j], i)
+			indegree[i]++
+		}
+	}
+
+	// Kahn's algorithm, only to detect cycles before anything is applied
+	remaining := slices.Clone(indegree)
+	var queue []int
+	for i, n := range remaining {
+		if n == 0 {
+			queue = append(queue, i)
+		}
+	}
+	visited := 0
+	for len(queue) > 0 {
+		i := queue[0]
+		queue = queue[1:]
+		visited++
+		for _, d := range dependents[i] {
+			remaining[d]--
+			if remaining[d] == 0 {
+				queue = append(queue, d)
+			}
+		}
+	}
+	if visited != len(effects) {
+		var cycle []Effect
+		for i, n := range remaining {
+			if n > 0 {
+				cycle = append(cycle, effects[i])
+			}
+		}
+		return nil, nil, &CyclicDependencyError{Effects: cycle}
+	}
+
+	return dependents, indegree, nil
+}
+
+// schedule applies effects with at most workers running concurrently. An
+// effect starts once all its dependencies have been applied; among ready
+// effects the one listed first starts first, so with a single worker and no
+// dependencies effects run in slice order.
+//
+// When keepGoing is false the first failure cancels running effects and
+// stops scheduling new ones. Otherwise every effect whose dependencies
+// succeeded is applied and effects depending on a failed one are skipped.
+// It returns the transactions of the applied effects in completion order.
+// If onDone is not nil, it is called with the index and error of every
+// effect that was started, from the calling goroutine.
+func schedule(
+	ctx context.Context,
+	workers int,
+	keepGoing bool,
+	effects []Effect,
+	apply func(context.Context, Effect) (Tx, error),
+	onDone func(int, error),
+) (txList, error) {
+	dependents, indegree, err := dependencyGraph(effects)
+	if err != nil {
+		return nil, err
+	}
+	workers = max(workers, 1)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		idx int
+		tx  Tx
+		err error
+	}
+	results := make(chan result)
+
+	var ready []int
+	for i, n := range indegree {
+		if n == 0 {
+			ready = append(ready, i)
+		}
+	}
+
+	var txs txList
+	var errs []error
+	running := 0
+	done := 0
+	for {
+		for running < workers && len(ready) > 0 {
+			i := ready[0]
+			ready = ready[1:]
+			running++
+			go func() {
+				tx, err := apply(ctx, effects[i])
+				results <- result{idx: i, tx: tx, err: err}
+			}()
+		}
+		if running == 0 {
+			break
+		}
+
+		r := <-results
+		running--
+		done++
+		if onDone != nil {
+			onDone(r.idx, r.err)
+		}
+		if r.err != nil {
+			errs = append(errs, r.err)
+			if !keepGoing {
+				cancel()
+				ready = nil
+			}
+			continue
+		}
+		txs = append(txs, r.tx)
+		if len(errs) > 0 && !keepGoing {
+			continue
+		}
+		for _, d := range dependents[r.idx] {
+			indegree[d]--
+			if indegree[d] == 0 {
+				pos, _ := slices.BinarySearch(ready, d)
+				ready = slices.Insert(ready, pos, d)
+			}
+		}
+	}
+
+	if keepGoing && done < len(effects) {
+		errs = append(errs, fmt.Errorf("%d effect(s) skipped because a dependency failed", len(effects)-done))
+	}
+	return txs, errors.Join(errs...)
+}
@@ -0,0 +1,157 @@
+package framework
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// recordingEffect appends its name to a shared log when applied.
+type recordingEffect struct {
+	name    string
+	log     *[]string
+	mu      *sync.Mutex
+	delay   time.Duration
+	err     error
+	running *atomic.Int32
+	peak    *atomic.Int32
+}
+
+func (r *recordingEffect) Apply() error {
+	if r.running != nil {
+		n := r.running.Add(1)
+		defer r.running.Add(-1)
+		for {
+			p := r.peak.Load()
+			if n <= p || r.peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+	}
+	time.Sleep(r.delay)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	*r.log = append(*r.log, r.name)
+	return r.err
+}
+
+func TestSchedule(t *testing.T) {
+	newEffect := func(name string, log *[]string, mu *sync.Mutex) *recordingEffect {
+		return &recordingEffect{name: name, log: log, mu: mu}
+	}
+
+	t.Run("applies effects in order with a single worker", func(t *testing.T) {
+		var log []string
+		var mu sync.Mutex
+		params := &InvokeParams{Rollback: true, Workers: 1}
+		err := InvokeWithParams(context.Background(), params,
+			newEffect("a", &log, &mu), newEffect("b", &log, &mu), newEffect("c", &log, &mu))
+		if err != nil {
+			t.Fatalf("InvokeWithParams() failed: %v", err)
+		}
+		if len(log) != 3 || log[0] != "a" || log[1] != "b" || log[2] != "c" {
+			t.Errorf("Expected [a b c], got %v", log)
+		}
+	})
+
+	t.Run("applies effects in order by default", func(t *testing.T) {
+		var log []string
+		var mu sync.Mutex
+		slow := newEffect("slow", &log, &mu)
+		slow.delay = 20 * time.Millisecond
+		if err := Invoke(context.Background(), slow, newEffect("fast", &log, &mu)); err != nil {
+			t.Fatalf("Invoke() failed: %v", err)
+		}
+		if len(log) != 2 || log[0] != "slow" || log[1] != "fast" {
+			t.Errorf("Expected [slow fast], got %v", log)
+		}
+	})
+
+	t.Run("respects declared dependencies", func(t *testing.T) {
+		var log []string
+		var mu sync.Mutex
+		first := newEffect("first", &log, &mu)
+		first.delay = 20 * time.Millisecond
+		second := After(newEffect("second", &log, &mu), first)
+		third := After(newEffect("third", &log, &mu), second)
+
+		params := &InvokeParams{Rollback: true, Workers: 4}
+		if err := InvokeWithParams(context.Background(), params, third, second, first); err != nil {
+			t.Fatalf("InvokeWithParams() failed: %v", err)
+		}
+		if len(log) != 3 || log[0] != "first" || log[1] != "second" || log[2] != "third" {
+			t.Errorf("Expected [first second third], got %v", log)
+		}
+	})
+
+	t.Run("limits concurrency to the number of workers", func(t *testing.T) {
+		var log []string
+		var mu sync.Mutex
+		var running, peak atomic.Int32
+		var effects []Effect
+		for range 8 {
+			e := newEffect("e", &log, &mu)
+			e.delay = 10 * time.Millisecond
+			e.running = &running
+			e.peak = &peak
+			effects = append(effects, e)
+		}
+
+		params := &InvokeParams{Rollback: true, Workers: 3}
+		if err := InvokeWithParams(context.Background(), params, effects...); err != nil {
+			t.Fatalf("InvokeWithParams() failed: %v", err)
+		}
+		if peak.Load() > 3 {
+			t.Errorf("Expected at most 3 concurrent effects, got %d", peak.Load())
+		}
+		if peak.Load() < 2 {
+			t.Errorf("Expected effects to run concurrently, peak was %d", peak.Load())
+		}
+		if len(log) != 8 {
+			t.Errorf("Expected 8 applied effects, got %d", len(log))
+		}
+	})
+
+	t.Run("skips dependents of failed effects", func(t *testing.T) {
+		var log []string
+		var mu sync.Mutex
+		failing := newEffect("failing", &log, &mu)
+		failing.err = errors.New("boom")
+		dependent := After(newEffect("dependent", &log, &mu), failing)
+		independent := newEffect("independent", &log, &mu)
+
+		params := &InvokeParams{Rollback: false, Workers: 2}
+		err := InvokeWithParams(context.Background(), params, failing, dependent, independent)
+		if err == nil {
+			t.Fatal("Expected error, got nil")
+		}
+		for _, name := range log {
+			if name == "dependent" {
+				t.Error("Expected dependent effect to be skipped")
+			}
+		}
+		if len(log) != 2 {
+			t.Errorf("Expected failing and independent effects to run, got %v", log)
+		}
+	})
+
+	t.Run("rejects cyclic dependencies", func(t *testing.T) {
+		var log []string
+		var mu sync.Mutex
+		a := After(newEffect("a", &log, &mu))
+		b := After(newEffect("b", &log, &mu), a)
+		a.Dependencies = append(a.Dependencies, b)
+
+		err := Invoke(context.Background(), a, b)
+		var cycleErr *CyclicDependencyError
+		if !errors.As(err, &cycleErr) {
+			t.Fatalf("Expected CyclicDependencyError, got %v", err)
+		}
+		if len(log) != 0 {
+			t.Errorf("Expected nothing to be applied, got %v", log)
+		}
+	})
+}
@@ -0,0 +1,606 @@
+package framework
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/getsops/sops/v3"
+	"github.com/getsops/sops/v3/aes"
+	"github.com/getsops/sops/v3/age"
+	"github.com/getsops/sops/v3/azkv"
+	"github.com/getsops/sops/v3/cmd/sops/common"
+	"github.com/getsops/sops/v3/cmd/sops/formats"
+	sopsConfig "github.com/getsops/sops/v3/config"
+	"github.com/getsops/sops/v3/gcpkms"
+	"github.com/getsops/sops/v3/hckms"
+	"github.com/getsops/sops/v3/hcvault"
+	"github.com/getsops/sops/v3/keys"
+	"github.com/getsops/sops/v3/keyservice"
+	"github.com/getsops/sops/v3/kms"
+	"github.com/getsops/sops/v3/pgp"
+	"github.com/getsops/sops/v3/version"
+	"github.com/niule-eu/hlcli/pkg/redact"
+	"golang.org/x/oauth2"
+)
+
+// NoMatchingCreationRuleError is returned when the SOPS configuration has no
+// creation rule matching the file being encrypted.
+type NoMatchingCreationRuleError struct {
+	ConfigPath string
+	Path       string
+}
+
+func (e *NoMatchingCreationRuleError) Error() string {
+	return fmt.Sprintf("no creation rule in %s matches %s", e.ConfigPath, e.Path)
+}
+
+// sopsConfigPath resolves the SOPS configuration file. An explicit path wins
+// over SOPS_CONFIG from envVars, which wins over a .sops.yaml discovered from
+// the working directory. It returns "" if there is none.
+func sopsConfigPath(explicit string, envVars map[string]string) string {
+	if explicit != "" {
+		return explicit
+	}
+	if envVars["SOPS_CONFIG"] != "" {
+		return envVars["SOPS_CONFIG"]
+	}
+	discoveredConfig, err := sopsConfig.FindConfigFile(".")
+	if err == nil {
+		return discoveredConfig
+	}
+	return ""
+}
+
+// loadCreationRule returns the creation rule of the SOPS configuration at
+// configPath matching path, the same way `sops encrypt --filename-override`
+// looks it up.
+func loadCreationRule(configPath string, path string) (*sopsConfig.Config, error) {
+	if configPath == "" {
+		return nil, fmt.Errorf("no SOPS configuration found to encrypt %s", path)
+	}
+	conf, err := sopsConfig.LoadCreationRuleForFile(configPath, path, nil)
+	if err != nil {
+		// The rule lookup only reports a missing match through the message
+		if err.Error() == "error loading config: no matching creation rules found" {
+			return nil, &NoMatchingCreationRuleError{ConfigPath: configPath, Path: path}
+		}
+		return nil, err
+	}
+	if conf == nil {
+		return nil, fmt.Errorf("no creation rules in %s", configPath)
+	}
+	return conf, nil
+}
+
+// SopsRule overrides the SOPS creation rule used to encrypt a file. Unset
+// fields keep the values of the creation rule matching the file.
+type SopsRule struct {
+	// Master keys encrypting the data key. If set, the file is encrypted
+	// with these instead of the keys of the creation rule, and no creation
+	// rule has to match.
+	KeyGroups       []SopsKeyGroup `json:"keyGroups"`
+	ShamirThreshold int            `json:"shamirThreshold"`
+	// Only one of these may be set. Setting any replaces the ones of the
+	// creation rule.
+	EncryptedRegex    string `json:"encryptedRegex"`
+	UnencryptedRegex  string `json:"unencryptedRegex"`
+	EncryptedSuffix   string `json:"encryptedSuffix"`
+	UnencryptedSuffix string `json:"unencryptedSuffix"`
+}
+
+// SopsKeyGroup lists the master keys of a key group, in the formats of
+// .sops.yaml.
+type SopsKeyGroup struct {
+	Age           []string `json:"age"`
+	PGP           []string `json:"pgp"`
+	KMS           []string `json:"kms"`           // ARNs
+	GCPKMS        []string `json:"gcpKms"`        // Resource IDs
+	AzureKeyVault []string `json:"azureKeyVault"` // Key URLs
+	HCVault       []string `json:"hcVault"`       // Transit URIs
+}
+
+func (g SopsKeyGroup) masterKeys() (sops.KeyGroup, error) {
+	var group sops.KeyGroup
+	for _, r := range g.Age {
+		ks, err := age.MasterKeysFromRecipients(r)
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range ks {
+			group = append(group, k)
+		}
+	}
+	for _, fp := range g.PGP {
+		for _, k := range pgp.MasterKeysFromFingerprintString(fp) {
+			group = append(group, k)
+		}
+	}
+	for _, arn := range g.KMS {
+		for _, k := range kms.MasterKeysFromArnString(arn, nil, "") {
+			group = append(group, k)
+		}
+	}
+	for _, id := range g.GCPKMS {
+		for _, k := range gcpkms.MasterKeysFromResourceIDString(id) {
+			group = append(group, k)
+		}
+	}
+	for _, u := range g.AzureKeyVault {
+		k, err := azkv.NewMasterKeyFromURL(u)
+		if err != nil {
+			return nil, err
+		}
+		group = append(group, k)
+	}
+	for _, u := range g.HCVault {
+		ks, err := hcvault.NewMasterKeysFromURIs(u)
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range ks {
+			group = append(group, k)
+		}
+	}
+	if len(group) == 0 {
+		return nil, errors.New("empty key group")
+	}
+	return group, nil
+}
+
+// creationRule returns the creation rule for path with the overrides of r
+// applied. The creation rule is looked up in the SOPS configuration at
+// configPath, unless r has its own key groups.
+func (r *SopsRule) creationRule(configPath string, path string) (*sopsConfig.Config, error) {
+	conf := &sopsConfig.Config{}
+	if len(r.KeyGroups) == 0 {
+		var err error
+		if conf, err = loadCreationRule(configPath, path); err != nil {
+			return nil, err
+		}
+	} else {
+		for i, g := range r.KeyGroups {
+			group, err := g.masterKeys()
+			if err != nil {
+				return nil, fmt.Errorf("key group %d for %s: %w", i, path, err)
+			}
+			conf.KeyGroups = append(conf.KeyGroups, group)
+		}
+	}
+	if r.ShamirThreshold != 0 {
+		conf.ShamirThreshold = r.ShamirThreshold
+	}
+	selectors := 0
+	for _, s := range []string{r.EncryptedRegex, r.UnencryptedRegex, r.EncryptedSuffix, r.UnencryptedSuffix} {
+		if s != "" {
+			selectors++
+		}
+	}
+	if selectors > 1 {
+		return nil, fmt.Errorf("only one of encrypted/unencrypted regex/suffix may be set to encrypt %s", path)
+	}
+	if selectors == 1 {
+		conf.EncryptedRegex = r.EncryptedRegex
+		conf.UnencryptedRegex = r.UnencryptedRegex
+		conf.EncryptedSuffix = r.EncryptedSuffix
+		conf.UnencryptedSuffix = r.UnencryptedSuffix
+	}
+	return conf, nil
+}
+
+// sopsEncrypt encrypts plaintext in-process with the key groups and
+// encryption settings of conf. The format of plaintext is derived from path.
+func sopsEncrypt(plaintext []byte, path string, configPath string, conf *sopsConfig.Config, svcs []keyservice.KeyServiceClient) ([]byte, error) {
+	store, err := sopsStore(path, configPath)
+	if err != nil {
+		return nil, err
+	}
+	branches, err := loadPlainBranches(store, plaintext, path)
+	if err != nil {
+		return nil, err
+	}
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	tree := sops.Tree{
+		Branches: branches,
+		Metadata: sops.Metadata{
+			KeyGroups:               conf.KeyGroups,
+			ShamirThreshold:         conf.ShamirThreshold,
+			UnencryptedSuffix:       conf.UnencryptedSuffix,
+			EncryptedSuffix:         conf.EncryptedSuffix,
+			UnencryptedRegex:        conf.UnencryptedRegex,
+			EncryptedRegex:          conf.EncryptedRegex,
+			UnencryptedCommentRegex: conf.UnencryptedCommentRegex,
+			EncryptedCommentRegex:   conf.EncryptedCommentRegex,
+			MACOnlyEncrypted:        conf.MACOnlyEncrypted,
+			Version:                 version.Version,
+		},
+		FilePath: absPath,
+	}
+
+	dataKey, errs := tree.GenerateDataKeyWithKeyServices(svcs)
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("could not generate data key for %s: %v", path, errs)
+	}
+
+	err = common.EncryptTree(common.EncryptTreeOpts{
+		DataKey: dataKey,
+		Tree:    &tree,
+		Cipher:  aes.NewCipher(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return store.EmitEncryptedFile(tree)
+}
+
+// UnsupportedSopsEnvError is returned for EnvVars of a SOPS effect that are
+// neither SOPS_CONFIG nor credentials of a key source.
+type UnsupportedSopsEnvError struct {
+	Name string
+}
+
+func (e *UnsupportedSopsEnvError) Error() string {
+	return fmt.Sprintf("unsupported SOPS environment variable %s", e.Name)
+}
+
+// sopsCredentials are the credentials of the SOPS key sources for one
+// operation. They are read from the EnvVars of an effect and handed to the
+// master keys explicitly, as the process environment is shared by operations
+// running concurrently. Key sources without credentials in EnvVars read them
+// from the process environment, as the sops binary does.
+type sopsCredentials struct {
+	ageSet     bool // SOPS_AGE_KEY or SOPS_AGE_KEY_FILE was given, even if empty
+	age        age.ParsedIdentities
+	gnuPGHome  pgp.GnuPGHome
+	aws        aws.CredentialsProvider
+	awsProfile string
+	gcp        gcpkms.CredentialJSON
+	gcpToken   oauth2.TokenSource
+	azure      azcore.TokenCredential
+	vaultToken hcvault.Token
+}
+
+// newSopsCredentials reads the credentials in envVars. Empty variables are
+// ignored, except for the age ones, which then leave no identity to decrypt
+// with.
+func newSopsCredentials(envVars map[string]string) (*sopsCredentials, error) {
+	c := &sopsCredentials{}
+	for name, value := range envVars {
+		var err error
+		switch name {
+		case "SOPS_CONFIG":
+			// Read by sopsConfigPath
+		case age.SopsAgeKeyEnv:
+			c.ageSet = true
+			err = c.age.Import(value)
+		case age.SopsAgeKeyFileEnv:
+			c.ageSet = true
+			if value != "" {
+				var keys []byte
+				if keys, err = os.ReadFile(value); err == nil {
+					err = c.age.Import(string(keys))
+				}
+			}
+		case "GNUPGHOME":
+			c.gnuPGHome = pgp.GnuPGHome(value)
+		case "AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN":
+			// Read below
+		case "AWS_PROFILE":
+			c.awsProfile = value
+		case gcpkms.SopsGoogleCredentialsEnv:
+			// A path to the credentials file or the credentials themselves
+			c.gcp = gcpkms.CredentialJSON(value)
+			if _, statErr := os.Stat(value); value != "" && statErr == nil {
+				c.gcp, err = os.ReadFile(value)
+			}
+		case gcpkms.SopsGoogleCredentialsOAuthTokenEnv:
+			if value != "" {
+				c.gcpToken = oauth2.StaticTokenSource(&oauth2.Token{AccessToken: value})
+			}
+		case "AZURE_TENANT_ID", "AZURE_CLIENT_ID", "AZURE_CLIENT_SECRET":
+			// Read below
+		case "VAULT_TOKEN":
+			c.vaultToken = hcvault.Token(value)
+		default:
+			if value != "" {
+				return nil, &UnsupportedSopsEnvError{Name: name}
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", name, err)
+		}
+	}
+	if id := envVars["AWS_ACCESS_KEY_ID"]; id != "" {
+		c.aws = credentials.NewStaticCredentialsProvider(id, envVars["AWS_SECRET_ACCESS_KEY"], envVars["AWS_SESSION_TOKEN"])
+	}
+	if tenant, client, secret := envVars["AZURE_TENANT_ID"], envVars["AZURE_CLIENT_ID"], envVars["AZURE_CLIENT_SECRET"]; tenant+client+secret != "" {
+		if tenant == "" || client == "" || secret == "" {
+			return nil, errors.New("AZURE_TENANT_ID, AZURE_CLIENT_ID and AZURE_CLIENT_SECRET must be set together")
+		}
+		var err error
+		if c.azure, err = azidentity.NewClientSecretCredential(tenant, client, secret, nil); err != nil {
+			return nil, fmt.Errorf("reading Azure credentials: %w", err)
+		}
+	}
+	return c, nil
+}
+
+// sopsKeyService is a local SOPS key service building the master keys of
+// requests with the credentials of one operation. Requests of the remote key
+// sources are cancelled with ctx, the one of the operation: SOPS calls key
+// services without a context of its own.
+type sopsKeyService struct {
+	ctx   context.Context
+	creds *sopsCredentials
+}
+
+// contextKey is implemented by the master keys of remote key sources.
+type contextKey interface {
+	EncryptContext(ctx context.Context, dataKey []byte) error
+	DecryptContext(ctx context.Context) ([]byte, error)
+}
+
+func (s sopsKeyService) Encrypt(_ context.Context, req *keyservice.EncryptRequest) (*keyservice.EncryptResponse, error) {
+	key, err := s.masterKey(req.Key)
+	if err != nil {
+		return nil, err
+	}
+	if k, ok := key.(contextKey); ok {
+		err = k.EncryptContext(s.ctx, req.Plaintext)
+	} else {
+		err = key.Encrypt(req.Plaintext)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &keyservice.EncryptResponse{Ciphertext: key.EncryptedDataKey()}, nil
+}
+
+func (s sopsKeyService) Decrypt(_ context.Context, req *keyservice.DecryptRequest) (*keyservice.DecryptResponse, error) {
+	key, err := s.masterKey(req.Key)
+	if err != nil {
+		return nil, err
+	}
+	key.SetEncryptedDataKey(req.Ciphertext)
+	var plaintext []byte
+	if k, ok := key.(contextKey); ok {
+		plaintext, err = k.DecryptContext(s.ctx)
+	} else {
+		plaintext, err = key.Decrypt()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &keyservice.DecryptResponse{Plaintext: plaintext}, nil
+}
+
+// masterKey returns the master key of a key service request with the
+// credentials of s applied.
+func (s sopsKeyService) masterKey(key *keyservice.Key) (keys.MasterKey, error) {
+	c := s.creds
+	switch k := key.GetKeyType().(type) {
+	case *keyservice.Key_AgeKey:
+		mk := &age.MasterKey{Recipient: k.AgeKey.Recipient}
+		if c.ageSet {
+			if len(c.age) == 0 {
+				return nil, fmt.Errorf("no age identity in %s or %s", age.SopsAgeKeyEnv, age.SopsAgeKeyFileEnv)
+			}
+			c.age.ApplyToMasterKey(mk)
+		}
+		return mk, nil
+	case *keyservice.Key_PgpKey:
+		mk := pgp.NewMasterKeyFromFingerprint(k.PgpKey.Fingerprint)
+		if c.gnuPGHome != "" {
+			c.gnuPGHome.ApplyToMasterKey(mk)
+		}
+		return mk, nil
+	case *keyservice.Key_KmsKey:
+		encryptionContext := make(map[string]*string, len(k.KmsKey.Context))
+		for name, value := range k.KmsKey.Context {
+			encryptionContext[name] = &value
+		}
+		mk := kms.NewMasterKeyWithProfile(k.KmsKey.Arn, k.KmsKey.Role, encryptionContext, k.KmsKey.AwsProfile)
+		if mk.AwsProfile == "" {
+			mk.AwsProfile = c.awsProfile
+		}
+		if c.aws != nil {
+			kms.NewCredentialsProvider(c.aws).ApplyToMasterKey(mk)
+		}
+		return mk, nil
+	case *keyservice.Key_GcpKmsKey:
+		mk := gcpkms.NewMasterKeyFromResourceID(k.GcpKmsKey.ResourceId)
+		if c.gcp != nil {
+			c.gcp.ApplyToMasterKey(mk)
+		}
+		if c.gcpToken != nil {
+			gcpkms.NewTokenSource(c.gcpToken).ApplyToMasterKey(mk)
+		}
+		return mk, nil
+	case *keyservice.Key_AzureKeyvaultKey:
+		mk := azkv.NewMasterKey(k.AzureKeyvaultKey.VaultUrl, k.AzureKeyvaultKey.Name, k.AzureKeyvaultKey.Version)
+		if c.azure != nil {
+			azkv.NewTokenCredential(c.azure).ApplyToMasterKey(mk)
+		}
+		return mk, nil
+	case *keyservice.Key_VaultKey:
+		mk := hcvault.NewMasterKey(k.VaultKey.VaultAddress, k.VaultKey.EnginePath, k.VaultKey.KeyName)
+		if c.vaultToken != "" {
+			c.vaultToken.ApplyToMasterKey(mk)
+		}
+		return mk, nil
+	case *keyservice.Key_HckmsKey:
+		return hckms.NewMasterKey(k.HckmsKey.KeyId)
+	default:
+		return nil, fmt.Errorf("unsupported SOPS key type %T", k)
+	}
+}
+
+// runSops runs op with key services using the credentials in envVars. The
+// requests of op to remote key sources are cancelled when ctx is done or
+// timeout elapses, and runSops waits for op to return.
+func runSops(ctx context.Context, timeout time.Duration, envVars map[string]string, op func(svcs []keyservice.KeyServiceClient) ([]byte, error)) ([]byte, error) {
+	if timeout == 0 {
+		timeout = DefaultSopsTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	creds, err := newSopsCredentials(envVars)
+	if err != nil {
+		return nil, redact.Default.Error(err)
+	}
+	svcs := []keyservice.KeyServiceClient{keyservice.NewCustomLocalClient(sopsKeyService{ctx: ctx, creds: creds})}
+	out, err := op(svcs)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return out, redact.Default.Error(err)
+}
+
+// sopsStore returns the store for the format of path, configured by the SOPS
+// configuration at configPath if there is one.
+func sopsStore(path string, configPath string) (common.Store, error) {
+	storesConfig := sopsConfig.NewStoresConfig()
+	if configPath != "" {
+		var err error
+		if storesConfig, err = sopsConfig.LoadStoresConfig(configPath); err != nil {
+			return nil, err
+		}
+	}
+	return common.StoreForFormat(formats.FormatForPath(path), storesConfig), nil
+}
+
+// loadPlainBranches parses plaintext, refusing documents that are already
+// encrypted.
+func loadPlainBranches(store common.Store, plaintext []byte, path string) (sops.TreeBranches, error) {
+	branches, err := store.LoadPlainFile(plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("parsing plaintext for %s: %w", path, err)
+	}
+	if len(branches) < 1 {
+		return nil, fmt.Errorf("cannot encrypt %s: it must contain at least one document", path)
+	}
+	if store.HasSopsTopLevelKey(branches[0]) {
+		return nil, fmt.Errorf("cannot encrypt %s: it is already encrypted", path)
+	}
+	return branches, nil
+}
+
+// loadEncryptedTree parses ciphertext and decrypts its values in place. It
+// returns the decrypted tree along with its data key.
+func loadEncryptedTree(store common.Store, ciphertext []byte, path string, svcs []keyservice.KeyServiceClient) (*sops.Tree, []byte, error) {
+	tree, err := store.LoadEncryptedFile(ciphertext)
+	if err != nil {
+		return nil, nil, fmt.Errorf("loading encrypted %s: %w", path, err)
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	tree.FilePath = absPath
+	dataKey, err := common.DecryptTree(common.DecryptTreeOpts{
+		Cipher:      aes.NewCipher(),
+		Tree:        &tree,
+		KeyServices: svcs,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return &tree, dataKey, nil
+}
+
+// sopsDecrypt decrypts ciphertext, whose format is derived from path.
+func sopsDecrypt(ciphertext []byte, path string, svcs []keyservice.KeyServiceClient) ([]byte, error) {
+	store, err := sopsStore(path, "")
+	if err != nil {
+		return nil, err
+	}
+	tree, _, err := loadEncryptedTree(store, ciphertext, path, svcs)
+	if err != nil {
+		return nil, err
+	}
+	return store.EmitPlainFile(tree.Branches)
+}
+
+// sopsReencrypt encrypts plaintext with the keys, settings and data key of
+// the already encrypted original, as `sops edit` does when saving.
+func sopsReencrypt(original []byte, plaintext []byte, path string, svcs []keyservice.KeyServiceClient) ([]byte, error) {
+	store, err := sopsStore(path, "")
+	if err != nil {
+		return nil, err
+	}
+	tree, dataKey, err := loadEncryptedTree(store, original, path, svcs)
+	if err != nil {
+		return nil, err
+	}
+	branches, err := loadPlainBranches(store, plaintext, path)
+	if err != nil {
+		return nil, err
+	}
+	tree.Branches = branches
+	err = common.EncryptTree(common.EncryptTreeOpts{
+		DataKey: dataKey,
+		Tree:    tree,
+		Cipher:  aes.NewCipher(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return store.EmitEncryptedFile(*tree)
+}
+
+// sopsRekey re-encrypts ciphertext without changing its values. If conf is
+// not nil, the key groups of the document are replaced by the ones of conf,
+// as `sops updatekeys` does. If rotate is set, a new data key is generated,
+// as `sops rotate` does.
+func sopsRekey(ciphertext []byte, path string, conf *sopsConfig.Config, rotate bool, svcs []keyservice.KeyServiceClient) ([]byte, error) {
+	store, err := sopsStore(path, "")
+	if err != nil {
+		return nil, err
+	}
+	tree, dataKey, err := loadEncryptedTree(store, ciphertext, path, svcs)
+	if err != nil {
+		return nil, err
+	}
+
+	if conf != nil {
+		threshold := tree.Metadata.ShamirThreshold
+		if conf.ShamirThreshold != 0 {
+			threshold = conf.ShamirThreshold
+		}
+		tree.Metadata.KeyGroups = conf.KeyGroups
+		tree.Metadata.ShamirThreshold = min(threshold, len(conf.KeyGroups))
+	}
+	if rotate {
+		var errs []error
+		if dataKey, errs = tree.GenerateDataKeyWithKeyServices(svcs); len(errs) > 0 {
+			return nil, fmt.Errorf("could not generate data key for %s: %v", path, errs)
+		}
+	} else if errs := tree.Metadata.UpdateMasterKeysWithKeyServices(dataKey, svcs); len(errs) > 0 {
+		return nil, fmt.Errorf("could not update master keys of %s: %v", path, errs)
+	}
+
+	err = common.EncryptTree(common.EncryptTreeOpts{
+		DataKey: dataKey,
+		Tree:    tree,
+		Cipher:  aes.NewCipher(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return store.EmitEncryptedFile(*tree)
+}
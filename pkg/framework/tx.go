@@ -0,0 +1,210 @@
+package framework
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Tx is the outcome of an effect applied as part of a transaction. Once every
+// effect of a run has been applied, either all of them are committed or all of
+// them are rolled back, in reverse order.
+type Tx interface {
+	Commit() error
+	Rollback() error
+}
+
+// Transactional is implemented by effects that can undo themselves.
+// ApplyTx does what ApplyContext does, but keeps whatever is needed to restore
+// the previous state until the returned Tx is committed or rolled back.
+type Transactional interface {
+	ApplyTx(ctx context.Context) (Tx, error)
+}
+
+// noTx is used for effects that have nothing to undo, or cannot be undone.
+type noTx struct{}
+
+func (noTx) Commit() error   { return nil }
+func (noTx) Rollback() error { return nil }
+
+// txFuncs adapts a pair of functions to Tx. Nil functions do nothing.
+type txFuncs struct {
+	commit   func() error
+	rollback func() error
+}
+
+func (t txFuncs) Commit() error {
+	if t.commit == nil {
+		return nil
+	}
+	return t.commit()
+}
+
+func (t txFuncs) Rollback() error {
+	if t.rollback == nil {
+		return nil
+	}
+	return t.rollback()
+}
+
+// txList commits and rolls back a sequence of transactions in reverse order.
+type txList []Tx
+
+func (l txList) Commit() error {
+	var errs []error
+	for i := len(l) - 1; i >= 0; i-- {
+		if err := l[i].Commit(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (l txList) Rollback() error {
+	var errs []error
+	for i := len(l) - 1; i >= 0; i-- {
+		if err := l[i].Rollback(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// applyTx applies e transactionally when it supports it, and plainly otherwise.
+func applyTx(ctx context.Context, e Effect) (Tx, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if t, ok := e.(Transactional); ok {
+		return t.ApplyTx(ctx)
+	}
+	if err := WithContext(e).ApplyContext(ctx); err != nil {
+		return nil, err
+	}
+	return noTx{}, nil
+}
+
+// ApplyTx snapshots the file at Path before writing it. Rolling back restores
+// the previous content and permissions, or removes the file if it did not
+// exist. Special files and standard streams are written directly and cannot
+// be rolled back.
+func (fw FileWriteIO) ApplyTx(ctx context.Context) (Tx, error) {
+	info, err := os.Stat(fw.Path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		if err := fw.Apply(); err != nil {
+			return nil, err
+		}
+		return txFuncs{rollback: func() error { return os.Remove(fw.Path) }}, nil
+	case err != nil:
+		return nil, err
+	case !info.Mode().IsRegular() || isStreamPath(fw.Path):
+		if err := fw.Apply(); err != nil {
+			return nil, err
+		}
+		return noTx{}, nil
+	}
+
+	previous, err := os.ReadFile(fw.Path)
+	if err != nil {
+		return nil, err
+	}
+	if err := fw.Apply(); err != nil {
+		return nil, err
+	}
+	restore := FileWriteIO{
+		Path:        fw.Path,
+		Content:     &previous,
+		Mode:        os.O_CREATE | os.O_WRONLY | os.O_TRUNC,
+		Permissions: info.Mode().Perm(),
+	}
+	return txFuncs{rollback: restore.Apply}, nil
+}
+
+// ApplyTx moves the file at Path aside instead of calling Op. Committing
+// moves it back and calls Op, rolling back only moves it back in place.
+func (fdio *FileDeleteIO) ApplyTx(ctx context.Context) (Tx, error) {
+	if _, err := os.Lstat(fdio.Path); err != nil {
+		return nil, err
+	}
+	trash, err := os.MkdirTemp(filepath.Dir(fdio.Path), ".hlcli-trash-*")
+	if err != nil {
+		return nil, err
+	}
+	trashed := filepath.Join(trash, filepath.Base(fdio.Path))
+	if err := os.Rename(fdio.Path, trashed); err != nil {
+		os.Remove(trash)
+		return nil, err
+	}
+	restore := func() error {
+		if err := os.Rename(trashed, fdio.Path); err != nil {
+			return fmt.Errorf("restoring %s from %s: %w", fdio.Path, trashed, err)
+		}
+		return os.Remove(trash)
+	}
+	return txFuncs{
+		commit: func() error {
+			if err := restore(); err != nil {
+				return err
+			}
+			return fdio.Apply()
+		},
+		rollback: restore,
+	}, nil
+}
+
+// ApplyTx encrypts the plaintext in place. Rolling back puts the plaintext
+// back into the buffer.
+func (e *SopsEncryptEffect) ApplyTx(ctx context.Context) (Tx, error) {
+	return applyInPlaceTx(ctx, e, e.Plaintext)
+}
+
+// ApplyTx decrypts the ciphertext in place. Rolling back puts the ciphertext
+// back into the buffer.
+func (e *SopsDecryptEffect) ApplyTx(ctx context.Context) (Tx, error) {
+	return applyInPlaceTx(ctx, e, e.Ciphertext)
+}
+
+// ApplyTx re-encrypts the content in place. Rolling back puts the previous
+// ciphertext back into the buffer.
+func (e *SopsRekeyEffect) ApplyTx(ctx context.Context) (Tx, error) {
+	return applyInPlaceTx(ctx, e, e.Content)
+}
+
+// applyInPlaceTx applies an effect transforming buf in place. Rolling back
+// restores the previous content of buf.
+func applyInPlaceTx(ctx context.Context, e ContextEffect, buf *[]byte) (Tx, error) {
+	previous := append([]byte(nil), *buf...)
+	if err := e.ApplyContext(ctx); err != nil {
+		return nil, err
+	}
+	return txFuncs{rollback: func() error {
+		*buf = previous
+		return nil
+	}}, nil
+}
+
+// ApplyTx applies the effects in order and stops at the first failure, after
+// rolling back the effects that already succeeded.
+func (fw CompoundEffect) ApplyTx(ctx context.Context) (Tx, error) {
+	return invokeTx(ctx, fw.Effects...)
+}
+
+// invokeTx applies effects in order. On failure, the effects applied so far
+// are rolled back and the error is returned along with any rollback errors.
+func invokeTx(ctx context.Context, effect ...Effect) (txList, error) {
+	var txs txList
+	for _, e := range effect {
+		tx, err := applyTx(ctx, e)
+		if err != nil {
+			if rbErr := txs.Rollback(); rbErr != nil {
+				return nil, errors.Join(err, fmt.Errorf("rollback failed: %w", rbErr))
+			}
+			return nil, err
+		}
+		txs = append(txs, tx)
+	}
+	return txs, nil
+}
@@ -0,0 +1,123 @@
+package framework
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInvokeRollback(t *testing.T) {
+	newContent := []byte("new")
+	failing := NewDefaultFileWriteIO("/invalid/path/file.txt", &newContent)
+
+	setup := func(t *testing.T) (string, string, string) {
+		dir := t.TempDir()
+		existing := filepath.Join(dir, "existing.txt")
+		deleted := filepath.Join(dir, "deleted.txt")
+		created := filepath.Join(dir, "created.txt")
+		if err := os.WriteFile(existing, []byte("old"), 0600); err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+		if err := os.WriteFile(deleted, []byte("to delete"), 0644); err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+		return existing, deleted, created
+	}
+
+	t.Run("rolls back applied effects on failure", func(t *testing.T) {
+		existing, deleted, created := setup(t)
+
+		err := Invoke(
+			context.Background(),
+			NewDefaultFileWriteIO(existing, &newContent),
+			&FileDeleteIO{Path: deleted, Op: os.Remove},
+			CompoundEffect{Effects: []Effect{NewDefaultFileWriteIO(created, &newContent), failing}},
+		)
+		if err == nil {
+			t.Fatal("Expected error from invalid path, got nil")
+		}
+
+		content, err := os.ReadFile(existing)
+		if err != nil || string(content) != "old" {
+			t.Errorf("Expected %s to be restored to 'old', got '%s' (%v)", existing, content, err)
+		}
+		if info, err := os.Stat(existing); err != nil || info.Mode().Perm() != 0600 {
+			t.Errorf("Expected %s to keep its permissions", existing)
+		}
+		content, err = os.ReadFile(deleted)
+		if err != nil || string(content) != "to delete" {
+			t.Errorf("Expected %s to be restored, got '%s' (%v)", deleted, content, err)
+		}
+		if _, err := os.Stat(created); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed by rollback", created)
+		}
+		entries, _ := os.ReadDir(filepath.Dir(existing))
+		if len(entries) != 2 {
+			t.Errorf("Expected no leftover trash, got %d entries", len(entries))
+		}
+	})
+
+	t.Run("commits deletes on success", func(t *testing.T) {
+		existing, deleted, _ := setup(t)
+
+		err := Invoke(
+			context.Background(),
+			NewDefaultFileWriteIO(existing, &newContent),
+			&FileDeleteIO{Path: deleted, Op: os.Remove},
+		)
+		if err != nil {
+			t.Fatalf("Invoke() failed: %v", err)
+		}
+		if _, err := os.Stat(deleted); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be deleted", deleted)
+		}
+		entries, _ := os.ReadDir(filepath.Dir(existing))
+		if len(entries) != 1 {
+			t.Errorf("Expected trash to be emptied, got %d entries", len(entries))
+		}
+	})
+
+	t.Run("deletes with Op on commit", func(t *testing.T) {
+		_, deleted, _ := setup(t)
+
+		var removed []string
+		op := func(path string) error {
+			removed = append(removed, path)
+			return os.Rename(path, path+".bak")
+		}
+		if err := Invoke(context.Background(), &FileDeleteIO{Path: deleted, Op: op}); err != nil {
+			t.Fatalf("Invoke() failed: %v", err)
+		}
+		if len(removed) != 1 || removed[0] != deleted {
+			t.Errorf("Expected Op to be called with %s, got %v", deleted, removed)
+		}
+		if _, err := os.Stat(deleted + ".bak"); err != nil {
+			t.Errorf("Expected Op to move %s aside: %v", deleted, err)
+		}
+		entries, _ := os.ReadDir(filepath.Dir(deleted))
+		if len(entries) != 2 {
+			t.Errorf("Expected no leftover trash, got %d entries", len(entries))
+		}
+	})
+
+	t.Run("keeps going without rollback", func(t *testing.T) {
+		existing, _, created := setup(t)
+
+		err := InvokeWithParams(
+			context.Background(),
+			&InvokeParams{Rollback: false},
+			NewDefaultFileWriteIO(existing, &newContent),
+			failing,
+			NewDefaultFileWriteIO(created, &newContent),
+		)
+		if err == nil {
+			t.Fatal("Expected error from invalid path, got nil")
+		}
+		for _, p := range []string{existing, created} {
+			if content, err := os.ReadFile(p); err != nil || string(content) != "new" {
+				t.Errorf("Expected %s to contain 'new', got '%s' (%v)", p, content, err)
+			}
+		}
+	})
+}
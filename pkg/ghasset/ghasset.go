@@ -32,6 +32,14 @@ type ReleaseAssetResult struct {
 	Hash  *Checksum
 }
 
+func (r *ReleaseAssetResult) String() string {
+	s := fmt.Sprintf("%s/%s %s %s", r.Owner, r.Repo, r.Tag, r.Url)
+	if r.Hash != nil {
+		s += " " + r.Hash.Value
+	}
+	return s
+}
+
 func getAssetByPattern(assets []*github.ReleaseAsset, pattern string) *github.ReleaseAsset {
 	assetIdx := slices.IndexFunc(
 		assets,
@@ -53,7 +61,7 @@ func getAssetByPattern(assets []*github.ReleaseAsset, pattern string) *github.Re
 	}
 }
 
-func getChecksum(assetName string, assets []*github.ReleaseAsset, checksumsPattern *string) (*Checksum, error) {
+func getChecksum(ctx context.Context, assetName string, assets []*github.ReleaseAsset, checksumsPattern *string) (*Checksum, error) {
 	if checksumsPattern == nil {
 		return nil, nil
 	}
@@ -62,7 +70,7 @@ func getChecksum(assetName string, assets []*github.ReleaseAsset, checksumsPatte
 		return nil, fmt.Errorf("no asset matched pattern '%s'", *checksumsPattern)
 	}
 	httpClient := &http.Client{}
-	req, err := http.NewRequest("GET", *checksumsAsset.URL, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", *checksumsAsset.URL, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -89,13 +97,13 @@ func getChecksum(assetName string, assets []*github.ReleaseAsset, checksumsPatte
 	return &res, nil
 }
 
-func GetAsset(token string, raq ReleaseAssetQuery) (*ReleaseAssetResult, error) {
+func GetAsset(ctx context.Context, token string, raq ReleaseAssetQuery) (*ReleaseAssetResult, error) {
 	repos := github.NewClient(nil).WithAuthToken(token).Repositories
 	d, err := time.ParseDuration("30s")
 	if err != nil {
 		return nil, err
 	}
-	ctx, cancelFunc := context.WithTimeout(context.Background(), d)
+	ctx, cancelFunc := context.WithTimeout(ctx, d)
 	defer cancelFunc()
 	release, _, err := repos.GetLatestRelease(ctx, raq.Owner, raq.Repo)
 	if err != nil {
@@ -105,7 +113,7 @@ func GetAsset(token string, raq ReleaseAssetQuery) (*ReleaseAssetResult, error)
 	if asset == nil {
 		return nil, fmt.Errorf("no asset matched pattern '%s'", raq.Pattern)
 	}
-	checksum, err := getChecksum(*asset.Name, release.Assets, raq.ChecksumsPattern)
+	checksum, err := getChecksum(ctx, *asset.Name, release.Assets, raq.ChecksumsPattern)
 	if err != nil {
 		return nil, err
 	}
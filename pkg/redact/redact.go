@@ -0,0 +1,133 @@
+// Package redact masks known secret values in text before it reaches
+// terminals, CI logs or reports.
+package redact
+
+import (
+	"io"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Mask replaces every redacted value.
+const Mask = "[REDACTED]"
+
+// MinLength is the length below which values are not redacted. Masking short
+// values such as "1" or "true" would make every output unreadable.
+const MinLength = 4
+
+// Default is the process-wide Redactor, fed by config.LoadSecrets.
+var Default = &Redactor{}
+
+// Redactor masks a set of secret values. It is safe for concurrent use.
+type Redactor struct {
+	mu       sync.RWMutex
+	values   map[string]struct{}
+	replacer *strings.Replacer
+}
+
+// Add registers values to be masked. Multi-line values are also masked line
+// by line, since tools often quote only part of them in their output.
+func (r *Redactor) Add(values ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.values == nil {
+		r.values = map[string]struct{}{}
+	}
+	for _, v := range values {
+		candidates := []string{v}
+		if strings.Contains(v, "\n") {
+			candidates = append(candidates, strings.Split(v, "\n")...)
+		}
+		for _, c := range candidates {
+			c = strings.TrimSpace(c)
+			if len(c) >= MinLength {
+				r.values[c] = struct{}{}
+			}
+		}
+	}
+	r.replacer = nil
+}
+
+// Len returns the number of values being masked.
+func (r *Redactor) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.values)
+}
+
+func (r *Redactor) getReplacer() *strings.Replacer {
+	r.mu.RLock()
+	replacer := r.replacer
+	r.mu.RUnlock()
+	if replacer != nil {
+		return replacer
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.replacer == nil {
+		// Longest values first, so a secret containing another one is
+		// masked as a whole
+		values := make([]string, 0, len(r.values))
+		for v := range r.values {
+			values = append(values, v)
+		}
+		slices.SortFunc(values, func(a, b string) int { return len(b) - len(a) })
+		oldnew := make([]string, 0, 2*len(values))
+		for _, v := range values {
+			oldnew = append(oldnew, v, Mask)
+		}
+		r.replacer = strings.NewReplacer(oldnew...)
+	}
+	return r.replacer
+}
+
+// String returns s with every registered value masked.
+func (r *Redactor) String(s string) string {
+	if r.Len() == 0 {
+		return s
+	}
+	return r.getReplacer().Replace(s)
+}
+
+// Error wraps err so that its message is masked. The original error remains
+// available to errors.Is and errors.As.
+func (r *Redactor) Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &redactedError{err: err, r: r}
+}
+
+type redactedError struct {
+	err error
+	r   *Redactor
+}
+
+func (e *redactedError) Error() string {
+	return e.r.String(e.err.Error())
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// Writer returns a writer masking registered values before writing to w.
+// Values are only masked within a single Write call, which holds for the log
+// package and fmt.Fprint* calls.
+func (r *Redactor) Writer(w io.Writer) io.Writer {
+	return &writer{w: w, r: r}
+}
+
+type writer struct {
+	w io.Writer
+	r *Redactor
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.w, w.r.String(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,57 @@
+package redact
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"testing"
+)
+
+func TestRedactor(t *testing.T) {
+	r := &Redactor{}
+	r.Add("hunter2", "sk_live_abc123", "sk_live_abc123456", "on", "-----BEGIN KEY-----\nc2VjcmV0LWtleS1ib2R5\n-----END KEY-----")
+
+	t.Run("masks registered values", func(t *testing.T) {
+		got := r.String("password=hunter2 token=sk_live_abc123456")
+		expected := "password=" + Mask + " token=" + Mask
+		if got != expected {
+			t.Errorf("Expected %q, got %q", expected, got)
+		}
+	})
+
+	t.Run("ignores short values", func(t *testing.T) {
+		if got := r.String("turn it on"); got != "turn it on" {
+			t.Errorf("Expected short values to be kept, got %q", got)
+		}
+	})
+
+	t.Run("masks lines of multi-line values", func(t *testing.T) {
+		if got := r.String("stderr: c2VjcmV0LWtleS1ib2R5"); got != "stderr: "+Mask {
+			t.Errorf("Expected key line to be masked, got %q", got)
+		}
+	})
+
+	t.Run("masks errors and keeps them unwrappable", func(t *testing.T) {
+		base := errors.New("base")
+		err := r.Error(fmt.Errorf("failed with hunter2: %w", base))
+		if err.Error() != "failed with "+Mask+": base" {
+			t.Errorf("Unexpected error message %q", err.Error())
+		}
+		if !errors.Is(err, base) {
+			t.Error("Expected redacted error to wrap the original error")
+		}
+		if r.Error(nil) != nil {
+			t.Error("Expected nil error to stay nil")
+		}
+	})
+
+	t.Run("masks log output", func(t *testing.T) {
+		var out bytes.Buffer
+		logger := log.New(r.Writer(&out), "", 0)
+		logger.Println("value is hunter2")
+		if out.String() != "value is "+Mask+"\n" {
+			t.Errorf("Unexpected log output %q", out.String())
+		}
+	})
+}
@@ -19,6 +19,7 @@ type SopsExecEnvironment struct {
 	Cwd                          string
 	EncryptedKeys                []string
 	PartiallyEncryptedPathPrefix string
+	AgeRecipient                 string // Public key of SOPS_AGE_KEY
 }
 
 func (ee *SopsExecEnvironment) GetYamlPath() string {
@@ -75,6 +76,7 @@ func NewSopsExecEnv(t *testing.T) *SopsExecEnvironment {
 		Cwd:                          tempDir,
 		EncryptedKeys:                []string{"data", "stringData"},
 		PartiallyEncryptedPathPrefix: "hlcli-test",
+		AgeRecipient:                 publicKey,
 	}
 }
 